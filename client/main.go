@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
 	c "go-chat/common"
+	"go-chat/lib/client"
 
 	"github.com/alexflint/go-arg"
 	"github.com/charmbracelet/bubbles/help"
@@ -17,22 +19,24 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	ws "github.com/coder/websocket"
-	"github.com/coder/websocket/wsjson"
 )
 
-const manText string = `The current available commands are:
-  man
-    prints this message
-  mv <string>
-    set your nick
-  ls
-    get the available rooms
-  cd <string>
-    connect to a room
-  who
-    list users in the current room
-  moo
-    :)`
+func manText(cmds []c.Command) string {
+	text := "The current available commands are:\n  man\n    prints this message"
+	for _, cmd := range cmds {
+		if cmd.Perm == "admin" {
+			continue
+		}
+		text += "\n  " + strings.TrimSpace(cmd.Name+" "+cmd.Args) + "\n    " + cmd.Help
+		switch cmd.Perm {
+		case "op":
+			text += " (operators only)"
+		case "auth":
+			text += " (registered nicks only)"
+		}
+	}
+	return text + "\n  moo\n    :)"
+}
 
 const mooText string = `
                  (__)
@@ -55,24 +59,30 @@ type model struct {
 	kpHist  bool
 	history viewport.Model
 	msgs    []c.SMsg
+	from    int
+	mark    int64
+	read    int64
 	showTim showTim
+	showNum bool
 	tz      time.Location
 	input   textinput.Model
 	idStyle lipgloss.Style
 	pStyle  lipgloss.Style
 	help    help.Model
-	recvCh  chan c.SMsg
-	sendCh  chan c.CMsg
-	conn    *ws.Conn
-	exitCh  chan exit
+	cl      *client.Client
+	events  <-chan client.Event
+	latency time.Duration
 }
 
 type args struct {
-	Address     string  `arg:"positional" default:"gochat.8bit.lol" help:"address to connect to, without ws://" placeholder:"HOST[:PORT]"`
-	KeepHistory bool    `arg:"-k" help:"append chat history when changing rooms, instead of clearing"`
-	Timestamps  showTim `arg:"-t" default:"off" help:"display timestamps of messages, ctrl+t to cycle after startup [off, short, full]" placeholder:"CHOICE"`
-	Nick        *string `arg:"-n" help:"attempt to automatically set nick after connecting"`
-	Password    *string `arg:"-p" help:"password, if required"`
+	Address     string        `arg:"positional" default:"gochat.8bit.lol" help:"address to connect to, as HOST[:PORT], a ws:// or wss:// URL, or unix:///PATH for a unix socket" placeholder:"ADDR"`
+	KeepHistory bool          `arg:"-k" help:"append chat history when changing rooms, instead of clearing"`
+	Timestamps  showTim       `arg:"-t" default:"off" help:"display timestamps of messages, ctrl+t to cycle after startup [off, short, full]" placeholder:"CHOICE"`
+	MessageIds  bool          `arg:"-i" help:"display message ids, ctrl+n to toggle after startup"`
+	Nick        *string       `arg:"-n" help:"attempt to automatically set nick after connecting"`
+	Password    *string       `arg:"-p" help:"password, if required"`
+	Binary      bool          `arg:"-b" help:"use the binary CBOR encoding, if the server supports it"`
+	Compression c.Compression `arg:"--compression" default:"no-context" help:"websocket compression, if the server supports it [off, context, no-context]" placeholder:"MODE"`
 }
 
 func (a *args) Version() string {
@@ -89,59 +99,32 @@ func main() {
 	var a args
 	arg.MustParse(&a)
 
-	conn, _, err := ws.Dial(ctx, "ws://"+a.Address, nil)
+	opts := client.Options{CBOR: a.Binary, Compression: a.Compression}
+	if a.Nick != nil {
+		opts.Nick = *a.Nick
+		if a.Password != nil {
+			opts.Password = *a.Password
+		}
+	}
+
+	cl, err := client.Connect(ctx, a.Address, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close(ws.StatusNormalClosure, "")
+	defer cl.Close()
 
 	local, err := time.LoadLocation("Local")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	p := tea.NewProgram(initModel(ctx, conn, a, *local), tea.WithAltScreen(), tea.WithMouseCellMotion())
+	p := tea.NewProgram(initModel(cl, a, *local), tea.WithAltScreen(), tea.WithMouseCellMotion())
 	if _, err := p.Run(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func initModel(ctx context.Context, conn *ws.Conn, a args, tz time.Location) model {
-	discCtx, disc := context.WithCancel(ctx)
-	exitCh := make(chan exit)
-
-	recvCh := make(chan c.SMsg)
-	go func() {
-		smsg := c.SMsg{}
-		for {
-			err := wsjson.Read(ctx, conn, &smsg)
-			if err != nil {
-				if ws.CloseStatus(err) != ws.StatusNormalClosure {
-					log.Println(err)
-				}
-				disc()
-				return
-			}
-			recvCh <- smsg
-		}
-	}()
-
-	sendCh := make(chan c.CMsg)
-	go func() {
-		for {
-			select {
-			case cmsg := <-sendCh:
-				err := wsjson.Write(ctx, conn, cmsg)
-				if err != nil {
-					recvCh <- c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("wsjson error when sending message: %v", err)}
-				}
-			case <-discCtx.Done():
-				exitCh <- exit{}
-				return
-			}
-		}
-	}()
-
+func initModel(cl *client.Client, a args, tz time.Location) model {
 	ta := textinput.New()
 	ta.Placeholder = "Send a message (or a command with /)"
 	ta.Focus()
@@ -168,30 +151,26 @@ func initModel(ctx context.Context, conn *ws.Conn, a args, tz time.Location) mod
 		),
 	}
 
-	if a.Nick != nil {
-		login := *a.Nick
-		if a.Password != nil {
-			login += ":" + *a.Password
-		}
-		sendCh <- c.CMsg{Typ: c.Mv, Msg: login}
-	}
-
 	messages := []c.SMsg{{Tim: time.Now(), Id: "system", Msg: "Welcome to the chat room! Press Enter to send, /man for more info :)"}}
+	if hello, ok := cl.Hello(); ok {
+		ta.CharLimit = hello.MaxLen
+	} else {
+		messages = append(messages, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Warning: server does not support %v, it may be an older version and some commands may not work", c.Protocol)})
+	}
 
 	return model{
 		input:   ta,
 		msgs:    messages,
 		showTim: a.Timestamps,
+		showNum: a.MessageIds,
 		tz:      tz,
 		kpHist:  a.KeepHistory,
 		history: vp,
 		idStyle: lipgloss.NewStyle().Width(60),
 		pStyle:  lipgloss.NewStyle().Bold(true),
 		help:    help.New(),
-		recvCh:  recvCh,
-		sendCh:  sendCh,
-		conn:    conn,
-		exitCh:  exitCh,
+		cl:      cl,
+		events:  cl.Subscribe(),
 	}
 }
 
@@ -199,24 +178,33 @@ func (m model) Init() tea.Cmd {
 	return tea.Batch(
 		tea.SetWindowTitle("go-chat by 8bit"),
 		textinput.Blink,
-		getNextSMsg(m.recvCh),
-		getExitMsg(m.exitCh),
+		getNextEvent(m.events),
 	)
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	var tiCmd, vpCmd, smCmd tea.Cmd
+	var tiCmd, vpCmd, smCmd, lcCmd, rdCmd tea.Cmd
 	m.input, tiCmd = m.input.Update(msg)
 	m.history, vpCmd = m.history.Update(msg)
 
 	switch msg := msg.(type) {
 	case exit:
 		return m, tea.Quit
+	case client.Event:
+		switch msg.Type {
+		case client.Message:
+			m.receive(msg.Msg)
+		case client.Disconnected:
+			m.latency = 0
+			if ws.CloseStatus(msg.Err) != ws.StatusNormalClosure {
+				log.Println(msg.Err)
+			}
+		case client.Pong:
+			m.latency = msg.Latency
+		}
+		smCmd = getNextEvent(m.events)
 	case c.SMsg:
-		m.msgs = append(m.msgs, msg)
-		m.history.SetContent(m.viewMessages())
-		m.history.GotoBottom()
-		smCmd = getNextSMsg(m.recvCh)
+		m.receive(msg)
 	case tea.KeyMsg:
 		switch msg.Type {
 		case tea.KeyCtrlC, tea.KeyEsc:
@@ -224,31 +212,27 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case tea.KeyCtrlT:
 			m.showTim = (m.showTim + 1) % 3
 			m.history.SetContent(m.viewMessages())
+		case tea.KeyCtrlN:
+			m.showNum = !m.showNum
+			m.history.SetContent(m.viewMessages())
 		case tea.KeyEnter:
 			text := strings.TrimSpace(m.input.Value())
-			if text, ok := strings.CutPrefix(text, "/"); ok {
-				if text == "man" {
-					m.recvCh <- c.SMsg{Tim: time.Now(), Id: "system", Msg: manText}
-				} else if text, ok := strings.CutPrefix(text, "mv "); ok {
-					m.sendCh <- c.CMsg{Typ: c.Mv, Msg: text}
-				} else if text == "ls" {
-					m.sendCh <- c.CMsg{Typ: c.Ls, Msg: ""}
-				} else if text, ok := strings.CutPrefix(text, "cd "); ok {
+			if text == "/man" {
+				lcCmd = local(c.SMsg{Tim: time.Now(), Id: "system", Msg: manText(m.cl.Commands())})
+			} else if text == "/moo" {
+				lcCmd = local(c.SMsg{Tim: time.Now(), Id: "cow", Msg: mooText})
+			} else if cmsg, ok := m.cl.Parse(text); ok {
+				if cmsg.Typ == c.Cd {
 					if !m.kpHist {
 						m.msgs = []c.SMsg{}
 					}
-					m.sendCh <- c.CMsg{Typ: c.Cd, Msg: text}
-				} else if text == "who" {
-					m.sendCh <- c.CMsg{Typ: c.Who, Msg: ""}
-				} else if text, ok := strings.CutPrefix(text, "sudo "); ok {
-					m.sendCh <- c.CMsg{Typ: c.Sudo, Msg: text}
-				} else if text == "moo" {
-					m.recvCh <- c.SMsg{Tim: time.Now(), Id: "cow", Msg: mooText}
-				} else {
-					m.recvCh <- c.SMsg{Tim: time.Now(), Id: "system", Msg: "Unrecognised command, use /man for more info"}
+					m.from = len(m.msgs)
+					m.mark = 0
+					m.read = 0
 				}
-			} else if text != "" {
-				m.sendCh <- c.CMsg{Typ: c.Echo, Msg: text}
+				lcCmd = m.send(cmsg)
+			} else if strings.HasPrefix(text, "/") {
+				lcCmd = local(c.SMsg{Tim: time.Now(), Id: "system", Msg: "Unrecognised command, use /man for more info"})
 			}
 			m.input.Reset()
 		}
@@ -258,11 +242,59 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.history.GotoBottom()
 		m.input.Width = msg.Width - 3
 		m.idStyle = m.idStyle.Width(msg.Width)
-		m.help.Width = msg.Width
+		m.help.Width = msg.Width - 16
 		m.history.SetContent(m.viewMessages())
 	}
 
-	return m, tea.Batch(tiCmd, vpCmd, smCmd)
+	if m.history.AtBottom() {
+		if num := m.lastNum(); num > m.read {
+			m.read = num
+			rdCmd = m.send(c.CMsg{Typ: c.Read, Msg: fmt.Sprint(num)})
+		}
+	}
+
+	return m, tea.Batch(tiCmd, vpCmd, smCmd, lcCmd, rdCmd)
+}
+
+func (m *model) receive(msg c.SMsg) {
+	switch msg.Typ {
+	case c.Mark:
+		m.mark = msg.Num
+	case c.Poll:
+		if i := slices.IndexFunc(m.msgs[m.from:], func(s c.SMsg) bool { return s.Num == msg.Num }); i >= 0 {
+			m.msgs[m.from+i] = msg
+		} else {
+			m.msgs = append(m.msgs, msg)
+		}
+	case c.Expire:
+		m.msgs = append(m.msgs[:m.from], slices.DeleteFunc(m.msgs[m.from:], func(s c.SMsg) bool {
+			return s.Num == msg.Num
+		})...)
+	case c.Nick, c.Room, c.Rooms:
+		// the server's text reply is shown instead
+		return
+	default:
+		m.msgs = append(m.msgs, msg)
+	}
+	m.history.SetContent(m.viewMessages())
+	m.history.GotoBottom()
+}
+
+func (m model) send(cmsg c.CMsg) tea.Cmd {
+	err := m.cl.Command(context.Background(), cmsg.Typ, cmsg.Msg)
+	if err != nil {
+		return local(c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("error when sending message: %v", err)})
+	}
+	return nil
+}
+
+func (m model) lastNum() int64 {
+	for i := len(m.msgs) - 1; i >= m.from; i-- {
+		if m.msgs[i].Num > 0 {
+			return m.msgs[i].Num
+		}
+	}
+	return 0
 }
 
 func (m model) View() string {
@@ -270,10 +302,23 @@ func (m model) View() string {
 		"%s\n%s\n%s",
 		m.history.View(),
 		m.input.View(),
-		m.help.View(m),
+		m.viewStatus(),
 	)
 }
 
+// viewStatus shows the key help with the latency to the server on the right.
+func (m model) viewStatus() string {
+	status := "ping -"
+	if m.latency > 0 {
+		status = fmt.Sprintf("ping %v", m.latency.Round(100*time.Microsecond))
+	}
+	status = m.help.Styles.ShortDesc.Render(status)
+
+	help := m.help.View(m)
+	gap := max(m.history.Width-lipgloss.Width(help)-lipgloss.Width(status), 1)
+	return help + strings.Repeat(" ", gap) + status
+}
+
 func (m model) ShortHelp() []key.Binding {
 	return []key.Binding{
 		m.history.KeyMap.PageDown,
@@ -284,6 +329,10 @@ func (m model) ShortHelp() []key.Binding {
 			key.WithKeys("ctrl+t"),
 			key.WithHelp("ctrl+t", "toggle timestamps"),
 		),
+		key.NewBinding(
+			key.WithKeys("ctrl+n"),
+			key.WithHelp("ctrl+n", "toggle message ids"),
+		),
 	}
 }
 
@@ -300,12 +349,32 @@ func (m model) viewMessages() string {
 		} else if m.showTim == full {
 			prefix += m.msgs[i].Tim.In(&m.tz).Format(time.DateTime) + " "
 		}
-		if m.msgs[i].Id == "system" {
+		if m.showNum && m.msgs[i].Num > 0 {
+			prefix += fmt.Sprintf("#%v ", m.msgs[i].Num)
+		}
+		if m.msgs[i].Exp != nil {
+			prefix += "⌛ "
+		}
+		style := m.idStyle
+		switch {
+		case m.msgs[i].Typ == c.Announce:
+			prefix += m.pStyle.Foreground(lipgloss.Color("201")).Render("***")
+			style = style.Bold(true)
+		case m.msgs[i].Id == "system":
 			prefix += m.pStyle.Foreground(lipgloss.Color("201")).Render("system:")
-		} else {
+		case m.msgs[i].Typ == c.Action:
+			prefix += m.pStyle.Foreground(lipgloss.Color(prefixColor(m.msgs[i].Id))).Render("* " + m.msgs[i].Id)
+			style = style.Italic(true)
+		case m.msgs[i].Typ == c.Note:
+			prefix += m.pStyle.Foreground(lipgloss.Color(prefixColor(m.msgs[i].Id))).Render("-" + m.msgs[i].Id + "-")
+			style = style.Faint(true)
+		default:
 			prefix += m.pStyle.Foreground(lipgloss.Color(prefixColor(m.msgs[i].Id))).Render(m.msgs[i].Id + ":")
 		}
-		s += m.idStyle.SetString(prefix).Render(m.msgs[i].Msg) + "\n"
+		s += style.SetString(prefix).Render(m.msgs[i].Msg) + "\n"
+		if m.mark > 0 && i >= m.from && i < len(m.msgs)-1 && m.msgs[i].Num == m.mark {
+			s += m.pStyle.Foreground(lipgloss.Color("201")).Render("── new messages ──") + "\n"
+		}
 	}
 	return s[:len(s)-1]
 }
@@ -317,17 +386,21 @@ func prefixColor(s string) string {
 	return fmt.Sprint(uint(s[0]+s[len(s)-1]) % 8)
 }
 
-func getNextSMsg(c <-chan c.SMsg) tea.Cmd {
+func local(smsg c.SMsg) tea.Cmd {
 	return func() tea.Msg {
-		return <-c
+		return smsg
 	}
 }
 
 type exit struct{}
 
-func getExitMsg(c <-chan exit) tea.Cmd {
+func getNextEvent(c <-chan client.Event) tea.Cmd {
 	return func() tea.Msg {
-		return <-c
+		ev, ok := <-c
+		if !ok {
+			return exit{}
+		}
+		return ev
 	}
 }
 
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/coder/websocket"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ProtocolCBOR is Protocol with messages encoded as CBOR in binary frames
+// instead of JSON in text frames.
+const ProtocolCBOR = Protocol + ".cbor"
+
+// Codec encodes messages sent over a websocket connection.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	MessageType() websocket.MessageType
+}
+
+var (
+	JSON Codec = jsonCodec{}
+	CBOR Codec = cborCodec{mode: cborMode()}
+)
+
+// CodecFor returns the codec for a negotiated subprotocol, JSON is used if no
+// subprotocol was negotiated.
+func CodecFor(subprotocol string) Codec {
+	if subprotocol == ProtocolCBOR {
+		return CBOR
+	}
+	return JSON
+}
+
+// ReadMsg reads a message from conn and decodes it into v.
+func ReadMsg(ctx context.Context, conn *websocket.Conn, codec Codec, v any) error {
+	typ, data, err := conn.Read(ctx)
+	if err != nil {
+		return err
+	}
+	if typ != codec.MessageType() {
+		return fmt.Errorf("expected %v message, got %v", codec.MessageType(), typ)
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// WriteMsg encodes v and writes it to conn.
+func WriteMsg(ctx context.Context, conn *websocket.Conn, codec Codec, v any) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, codec.MessageType(), data)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) MessageType() websocket.MessageType {
+	return websocket.MessageText
+}
+
+type cborCodec struct {
+	mode cbor.EncMode
+}
+
+// cborMode encodes times as seconds since the epoch with microsecond precision.
+func cborMode() cbor.EncMode {
+	mode, err := cbor.EncOptions{Time: cbor.TimeUnixMicro}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+func (cc cborCodec) Marshal(v any) ([]byte, error) {
+	return cc.mode.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v any) error {
+	return cbor.Unmarshal(data, v)
+}
+
+func (cborCodec) MessageType() websocket.MessageType {
+	return websocket.MessageBinary
+}
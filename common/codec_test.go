@@ -0,0 +1,144 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+var codecs = []struct {
+	name  string
+	codec Codec
+}{
+	{"json", JSON},
+	{"cbor", CBOR},
+}
+
+func testMsg(i int) SMsg {
+	exp := time.Now().Add(time.Hour)
+	return SMsg{Tim: time.Now(), Id: "alice", Msg: fmt.Sprintf("message %v: %v", i, strings.Repeat("lorem ipsum ", 8)), Num: int64(i), Exp: &exp}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, tc := range codecs {
+		t.Run(tc.name, func(t *testing.T) {
+			in := testMsg(1)
+			data, err := tc.codec.Marshal(&in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := SMsg{}
+			if err := tc.codec.Unmarshal(data, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Msg != in.Msg || out.Num != in.Num || out.Tim.Sub(in.Tim).Abs() > time.Microsecond || out.Exp == nil {
+				t.Errorf("got %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+// dialSink returns a connection to a websocket server which decodes the
+// messages it reads with codec and sends n on done after every n of them.
+func dialSink(b *testing.B, codec Codec, n int, done chan<- int) *websocket.Conn {
+	b.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		conn.SetReadLimit(-1)
+		for i := 1; ; i++ {
+			m := SMsg{}
+			if err := ReadMsg(context.Background(), conn, codec, &m); err != nil {
+				return
+			}
+			if i%n == 0 {
+				done <- n
+			}
+		}
+	}))
+	b.Cleanup(ts.Close)
+
+	conn, _, err := websocket.Dial(b.Context(), "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.CloseNow() })
+	return conn
+}
+
+// BenchmarkHistoryReplay sends the recent history of a room to a client that
+// joins it, encoding each message.
+func BenchmarkHistoryReplay(b *testing.B) {
+	const history = 100
+	msgs := make([]SMsg, history)
+	for i := range msgs {
+		msgs[i] = testMsg(i + 1)
+	}
+
+	for _, tc := range codecs {
+		b.Run(tc.name, func(b *testing.B) {
+			done := make(chan int, 1)
+			conn := dialSink(b, tc.codec, history, done)
+			size := 0
+			for _, m := range msgs {
+				data, _ := tc.codec.Marshal(&m)
+				size += len(data)
+			}
+			b.SetBytes(int64(size))
+
+			for b.Loop() {
+				for i := range msgs {
+					if err := WriteMsg(b.Context(), conn, tc.codec, &msgs[i]); err != nil {
+						b.Fatal(err)
+					}
+				}
+				<-done
+			}
+			b.ReportMetric(float64(size)/history, "B/msg")
+		})
+	}
+}
+
+// BenchmarkBroadcast sends a message to every client in a room, encoding it
+// once.
+func BenchmarkBroadcast(b *testing.B) {
+	const clients = 20
+	msg := testMsg(1)
+
+	for _, tc := range codecs {
+		b.Run(tc.name, func(b *testing.B) {
+			done := make(chan int, clients)
+			conns := make([]*websocket.Conn, clients)
+			for i := range conns {
+				conns[i] = dialSink(b, tc.codec, 1, done)
+			}
+			data, _ := tc.codec.Marshal(&msg)
+			b.SetBytes(int64(len(data) * clients))
+
+			for b.Loop() {
+				data, err := tc.codec.Marshal(&msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, conn := range conns {
+					if err := conn.Write(b.Context(), tc.codec.MessageType(), data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for range clients {
+					<-done
+				}
+			}
+			b.ReportMetric(float64(len(data)), "B/msg")
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/coder/websocket"
+)
+
+// Compression is a permessage-deflate mode that can be set from command line
+// arguments and config files: off, context or no-context.
+type Compression websocket.CompressionMode
+
+const (
+	CompressionOff       = Compression(websocket.CompressionDisabled)
+	CompressionContext   = Compression(websocket.CompressionContextTakeover)
+	CompressionNoContext = Compression(websocket.CompressionNoContextTakeover)
+)
+
+func (m Compression) String() string {
+	switch m {
+	case CompressionOff:
+		return "off"
+	case CompressionContext:
+		return "context"
+	case CompressionNoContext:
+		return "no-context"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(m))
+	}
+}
+
+func (m *Compression) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "off":
+		*m = CompressionOff
+	case "context":
+		*m = CompressionContext
+	case "no-context":
+		*m = CompressionNoContext
+	default:
+		return fmt.Errorf("invalid compression: %s [off, context, no-context]", b)
+	}
+	return nil
+}
+
+func (m Compression) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Mode returns the websocket compression mode.
+func (m Compression) Mode() websocket.CompressionMode {
+	return websocket.CompressionMode(m)
+}
@@ -4,10 +4,46 @@ import "time"
 
 const Version = "0.2.12"
 
+// Protocol is the websocket subprotocol for this version of the protocol.
+// Clients that negotiate it are sent a Hello message after connecting, older
+// clients that do not request a subprotocol are still supported.
+const Protocol = "gochat.v1"
+
+type SMsgT int
+
+const (
+	Text SMsgT = iota
+	Mark
+	Action
+	Note
+	Announce
+	Expire
+	Poll
+	Commands
+	Hello
+	Nick
+	Room
+	Rooms
+)
+
+// Results sent in the Num of Nick and Room messages. They are sent to clients
+// that negotiate Protocol after a Mv or Cd, with the nick or room the client
+// has afterwards, which is unchanged if the command was refused.
+const (
+	Done int64 = iota
+	NickUsed
+	NickInvalid
+	NickBanned
+	RoomInvalid
+)
+
 type SMsg struct {
 	Tim time.Time
 	Id  string
 	Msg string
+	Typ SMsgT
+	Num int64
+	Exp *time.Time
 }
 
 type CMsgT int
@@ -19,9 +55,61 @@ const (
 	Ls
 	Cd
 	Who
+	Read
+	Pin
+	Unpin
+	Pins
+	Me
+	Notice
+	Temp
+	NewPoll
+	Vote
+	ClosePoll
+	Cmd
+	Cmds
 )
 
+var cmsgNames = []string{"sudo", "echo", "mv", "ls", "cd", "who", "read", "pin", "unpin", "pins", "me", "notice", "temp", "newpoll", "vote", "closepoll", "cmd", "cmds"}
+
+func (t CMsgT) String() string {
+	if t < 0 || int(t) >= len(cmsgNames) {
+		return "unknown"
+	}
+	return cmsgNames[t]
+}
+
 type CMsg struct {
 	Typ CMsgT
 	Msg string
 }
+
+// Command describes a slash command, the server sends the list of commands in
+// a Commands message in reply to Cmds. Commands with the Cmd type are sent as
+// Cmd messages containing the name and arguments.
+type Command struct {
+	Name string
+	Args string
+	Help string
+	Perm string
+	Typ  CMsgT
+}
+
+// RoomInfo describes a room, the server sends the list of rooms as JSON in a
+// Rooms message to clients that negotiate Protocol after connecting, after a
+// Mv or Cd and in reply to Ls. Unread is the number of messages a registered
+// nick has not read in the room.
+type RoomInfo struct {
+	Name   string
+	Unread int64
+}
+
+// ServerHello is sent as JSON in a Hello message to clients that negotiate
+// Protocol. MaxLen is the longest message accepted in characters, History is
+// the number of messages sent when joining a room.
+type ServerHello struct {
+	Version  string
+	Protocol string
+	MaxLen   int
+	History  int
+	Features []string
+}
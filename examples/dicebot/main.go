@@ -0,0 +1,110 @@
+// Command dicebot is an example bot built on the go-chat client library.
+//
+// It joins a room and answers !roll NdM with dice rolls and !echo <text> with
+// the text, reconnecting if the server restarts.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	c "go-chat/common"
+	"go-chat/lib/client"
+
+	"github.com/alexflint/go-arg"
+)
+
+type args struct {
+	Address  string `arg:"positional" default:"localhost:8080" help:"address to connect to, as HOST[:PORT], a ws:// or wss:// URL, or unix:///PATH for a unix socket" placeholder:"ADDR"`
+	Nick     string `arg:"-n" default:"dicebot" help:"nick for the bot"`
+	Password string `arg:"-p" help:"password, if required"`
+	Room     string `arg:"-r" default:"general" help:"room to join"`
+}
+
+func main() {
+	var a args
+	arg.MustParse(&a)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// history is replayed when joining a room, only answer newer messages
+	started := time.Now()
+	cl, err := client.Connect(ctx, a.Address, client.Options{
+		Nick:      a.Nick,
+		Password:  a.Password,
+		Room:      a.Room,
+		Reconnect: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cl.Close()
+
+	for ev := range cl.Subscribe() {
+		switch ev.Type {
+		case client.Disconnected:
+			log.Println("disconnected, reconnecting:", ev.Err)
+		case client.Reconnected:
+			log.Println("reconnected")
+		case client.Message:
+			if ev.Msg.Typ != c.Text || ev.Msg.Id == a.Nick || ev.Msg.Id == "system" || ev.Msg.Tim.Before(started) {
+				continue
+			}
+			if reply, ok := respond(ev.Msg.Id, ev.Msg.Msg); ok {
+				if err := cl.Send(ctx, reply); err != nil {
+					log.Println("send failed:", err)
+				}
+			}
+		}
+	}
+}
+
+func respond(nick string, msg string) (string, bool) {
+	if text, ok := strings.CutPrefix(msg, "!echo "); ok {
+		return text, true
+	}
+	if spec, ok := strings.CutPrefix(msg, "!roll"); ok {
+		rolls, total, err := roll(strings.TrimSpace(spec))
+		if err != nil {
+			return fmt.Sprintf("%v: %v", nick, err), true
+		}
+		return fmt.Sprintf("%v rolled %v = %v", nick, rolls, total), true
+	}
+	return "", false
+}
+
+// roll parses dice in NdM notation, e.g. 2d6, defaulting to 1d6.
+func roll(spec string) ([]int, int, error) {
+	if spec == "" {
+		spec = "1d6"
+	}
+	n, m, ok := strings.Cut(strings.ToLower(spec), "d")
+	if n == "" {
+		n = "1"
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || !ok || count < 1 || count > 100 {
+		return nil, 0, fmt.Errorf("usage: !roll NdM, e.g. !roll 2d6")
+	}
+	sides, err := strconv.Atoi(m)
+	if err != nil || sides < 2 || sides > 1000 {
+		return nil, 0, fmt.Errorf("usage: !roll NdM, e.g. !roll 2d6")
+	}
+
+	rolls := make([]int, count)
+	total := 0
+	for i := range rolls {
+		rolls[i] = rand.IntN(sides) + 1
+		total += rolls[i]
+	}
+	return rolls, total, nil
+}
@@ -0,0 +1,476 @@
+// Package client is a library for writing go-chat clients and bots.
+//
+// A Client holds a websocket connection to a go-chat server. Messages from the
+// server are delivered as events to subscribers, and the nick and room set
+// through the client are restored if it reconnects.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+)
+
+var ErrDisconnected = errors.New("disconnected from server")
+
+type EventType int
+
+const (
+	// A message from the server, in Msg.
+	Message EventType = iota
+	// The connection was lost, the error is in Err.
+	Disconnected
+	// The client reconnected after being disconnected.
+	Reconnected
+	// The server answered a keepalive ping, the round trip time is in Latency.
+	Pong
+)
+
+type Event struct {
+	Type    EventType
+	Msg     c.SMsg
+	Err     error
+	Latency time.Duration
+}
+
+type Options struct {
+	// Nick and Password are used to log in after connecting.
+	Nick     string
+	Password string
+	// Room is joined after connecting.
+	Room string
+	// Reconnect after the connection is lost, waiting between MinBackoff and
+	// MaxBackoff between attempts.
+	Reconnect  bool
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// CBOR asks the server for the binary c.ProtocolCBOR encoding, JSON is
+	// used if the server does not support it.
+	CBOR bool
+	// Compression is the permessage-deflate mode to offer, messages smaller
+	// than CompressionThreshold bytes are not compressed. Compression is off
+	// by default.
+	Compression          c.Compression
+	CompressionThreshold int
+	// ReadLimit is the maximum size in bytes of a message from the server,
+	// 1 MiB by default.
+	ReadLimit int64
+	// Ping the server every PingInterval, 30s by default or never if
+	// negative, and drop the connection if there is no pong within
+	// PingTimeout, 10s by default.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+}
+
+type Client struct {
+	url string
+	// path of the unix socket for unix:// addresses
+	socket string
+	opts   Options
+	ctx    context.Context
+	stop   context.CancelFunc
+
+	mu     sync.Mutex
+	conn   *ws.Conn
+	codec  c.Codec
+	login  string
+	room   string
+	subs   []chan Event
+	cmds   []c.Command
+	hello  *c.ServerHello
+	rtt    time.Duration
+	closed bool
+	start  sync.Once
+}
+
+// Connect dials addr, either HOST[:PORT], a ws:// or wss:// URL or the path of
+// a unix socket as unix:///run/go-chat/go-chat.sock, then logs
+// in and joins the room in opts. The client stops when ctx is cancelled or
+// Close is called.
+func Connect(ctx context.Context, addr string, opts Options) (*Client, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+	if opts.ReadLimit <= 0 {
+		opts.ReadLimit = 1 << 20
+	}
+	if opts.PingInterval == 0 {
+		opts.PingInterval = 30 * time.Second
+	}
+	if opts.PingTimeout <= 0 {
+		opts.PingTimeout = 10 * time.Second
+	}
+
+	url, socket := wsURL(addr)
+	cl := &Client{url: url, socket: socket, opts: opts, cmds: DefaultCommands}
+	if opts.Nick != "" {
+		cl.login = opts.Nick
+		if opts.Password != "" {
+			cl.login += ":" + opts.Password
+		}
+	}
+	cl.room = opts.Room
+
+	cl.ctx, cl.stop = context.WithCancel(ctx)
+	conn, err := cl.dial()
+	if err != nil {
+		cl.stop()
+		return nil, err
+	}
+	cl.conn = conn
+
+	return cl, nil
+}
+
+// dial connects to the server, reads the hello message if the server supports
+// c.Protocol and restores the nick and room.
+func (cl *Client) dial() (*ws.Conn, error) {
+	protocols := []string{c.Protocol}
+	if cl.opts.CBOR {
+		protocols = []string{c.ProtocolCBOR, c.Protocol}
+	}
+	opts := &ws.DialOptions{
+		Subprotocols:         protocols,
+		CompressionMode:      cl.opts.Compression.Mode(),
+		CompressionThreshold: cl.opts.CompressionThreshold,
+	}
+	if cl.socket != "" {
+		opts.HTTPClient = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", cl.socket)
+			},
+		}}
+	}
+	conn, _, err := ws.Dial(cl.ctx, cl.url, opts)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(cl.opts.ReadLimit)
+
+	codec := c.CodecFor(conn.Subprotocol())
+	var hello *c.ServerHello
+	if conn.Subprotocol() != "" {
+		hello, err = readHello(cl.ctx, conn, codec)
+		if err != nil {
+			conn.CloseNow()
+			return nil, err
+		}
+	}
+	cl.mu.Lock()
+	cl.hello = hello
+	cl.codec = codec
+	cl.mu.Unlock()
+
+	if err := cl.restore(conn, codec); err != nil {
+		conn.CloseNow()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func readHello(ctx context.Context, conn *ws.Conn, codec c.Codec) (*c.ServerHello, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	smsg := c.SMsg{}
+	if err := c.ReadMsg(ctx, conn, codec, &smsg); err != nil {
+		return nil, err
+	}
+	if smsg.Typ != c.Hello {
+		return nil, fmt.Errorf("expected hello from server, got: %v", smsg.Msg)
+	}
+
+	hello := &c.ServerHello{}
+	if err := json.Unmarshal([]byte(smsg.Msg), hello); err != nil {
+		return nil, fmt.Errorf("invalid hello from server: %w", err)
+	}
+	return hello, nil
+}
+
+// Hello returns the hello message sent by the server, or false if the server
+// does not support c.Protocol and may be incompatible.
+func (cl *Client) Hello() (c.ServerHello, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.hello == nil {
+		return c.ServerHello{}, false
+	}
+	return *cl.hello, true
+}
+
+// Supports reports whether the server advertised feature in its hello message.
+func (cl *Client) Supports(feature string) bool {
+	hello, ok := cl.Hello()
+	return ok && slices.Contains(hello.Features, feature)
+}
+
+// wsURL returns the URL to dial for addr, and the socket path for unix://
+// addresses, which are dialed as localhost over the socket.
+func wsURL(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return "ws://localhost/", path
+	}
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		return addr, ""
+	}
+	return "ws://" + addr, ""
+}
+
+// Subscribe returns a channel of events from the server. It is closed when
+// the client stops. Messages are read from the server once there is a
+// subscriber, so none are missed between connecting and subscribing. Events
+// are delivered to every subscriber in order, so subscribers must keep reading
+// to avoid holding up the client.
+func (cl *Client) Subscribe() <-chan Event {
+	ch := make(chan Event, 64)
+	cl.mu.Lock()
+	if cl.ctx.Err() != nil {
+		close(ch)
+	} else {
+		cl.subs = append(cl.subs, ch)
+	}
+	conn := cl.conn
+	cl.mu.Unlock()
+
+	if conn != nil {
+		cl.start.Do(func() { go cl.read(conn) })
+	}
+	return ch
+}
+
+// Login sets the nick, with a password if it is registered. The server
+// replies with a system message saying if it succeeded.
+func (cl *Client) Login(ctx context.Context, nick string, password string) error {
+	login := nick
+	if password != "" {
+		login += ":" + password
+	}
+	return cl.Command(ctx, c.Mv, login)
+}
+
+// Join changes to room, the server replies with the room history.
+func (cl *Client) Join(ctx context.Context, room string) error {
+	return cl.Command(ctx, c.Cd, room)
+}
+
+// Send sends text to the current room.
+func (cl *Client) Send(ctx context.Context, text string) error {
+	return cl.Command(ctx, c.Echo, text)
+}
+
+// Command sends a command to the server. Nick and room changes are remembered
+// and repeated after reconnecting.
+func (cl *Client) Command(ctx context.Context, typ c.CMsgT, msg string) error {
+	cl.mu.Lock()
+	conn, codec := cl.conn, cl.codec
+	switch typ {
+	case c.Mv:
+		cl.login = msg
+	case c.Cd:
+		cl.room = msg
+	}
+	cl.mu.Unlock()
+
+	if conn == nil {
+		return ErrDisconnected
+	}
+	return c.WriteMsg(ctx, conn, codec, c.CMsg{Typ: typ, Msg: msg})
+}
+
+// Close disconnects from the server and stops the client.
+func (cl *Client) Close() error {
+	cl.mu.Lock()
+	conn := cl.conn
+	cl.closed = true
+	cl.mu.Unlock()
+
+	defer cl.stop()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close(ws.StatusNormalClosure, "")
+}
+
+// restore requests the list of commands if supported, then logs in and joins the room set
+// on the client.
+func (cl *Client) restore(conn *ws.Conn, codec c.Codec) error {
+	cl.mu.Lock()
+	login, room := cl.login, cl.room
+	cl.mu.Unlock()
+
+	if cl.Supports("commands") {
+		if err := c.WriteMsg(cl.ctx, conn, codec, c.CMsg{Typ: c.Cmds}); err != nil {
+			return err
+		}
+	}
+	if login != "" {
+		if err := c.WriteMsg(cl.ctx, conn, codec, c.CMsg{Typ: c.Mv, Msg: login}); err != nil {
+			return err
+		}
+	}
+	if room != "" {
+		if err := c.WriteMsg(cl.ctx, conn, codec, c.CMsg{Typ: c.Cd, Msg: room}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cl *Client) read(conn *ws.Conn) {
+	defer cl.finish()
+	codec := cl.encoding()
+	stop := cl.keepalive(conn)
+	defer func() { stop() }()
+	for {
+		smsg := c.SMsg{}
+		err := c.ReadMsg(cl.ctx, conn, codec, &smsg)
+		if err == nil && smsg.Typ == c.Commands {
+			cmds := []c.Command{}
+			if json.Unmarshal([]byte(smsg.Msg), &cmds) == nil {
+				cl.mu.Lock()
+				cl.cmds = cmds
+				cl.mu.Unlock()
+			}
+			continue
+		}
+		if err == nil {
+			cl.publish(Event{Type: Message, Msg: smsg})
+			continue
+		}
+
+		stop()
+		cl.mu.Lock()
+		cl.conn = nil
+		cl.rtt = 0
+		closed := cl.closed
+		cl.mu.Unlock()
+		if closed || cl.ctx.Err() != nil {
+			return
+		}
+
+		cl.publish(Event{Type: Disconnected, Err: err})
+		if !cl.opts.Reconnect {
+			return
+		}
+		if conn = cl.redial(); conn == nil {
+			return
+		}
+		codec = cl.encoding()
+		stop = cl.keepalive(conn)
+		cl.publish(Event{Type: Reconnected})
+	}
+}
+
+// keepalive pings the server on conn, starting straight away so the latency is
+// known, until the returned function is called.
+// If the server does not answer, the connection is closed so the read loop
+// notices and reconnects.
+func (cl *Client) keepalive(conn *ws.Conn) context.CancelFunc {
+	ctx, cancel := context.WithCancel(cl.ctx)
+	if cl.opts.PingInterval < 0 {
+		return cancel
+	}
+
+	go func() {
+		ticker := time.NewTicker(cl.opts.PingInterval)
+		defer ticker.Stop()
+		for {
+			start := time.Now()
+			pctx, pcancel := context.WithTimeout(ctx, cl.opts.PingTimeout)
+			err := conn.Ping(pctx)
+			pcancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					conn.CloseNow()
+				}
+				return
+			}
+
+			rtt := time.Since(start)
+			cl.mu.Lock()
+			cl.rtt = rtt
+			cl.mu.Unlock()
+			cl.publish(Event{Type: Pong, Latency: rtt})
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return cancel
+}
+
+// Latency returns the round trip time of the last keepalive ping, or 0 if
+// there has not been one on the current connection.
+func (cl *Client) Latency() time.Duration {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.rtt
+}
+
+// encoding returns the codec negotiated for the current connection.
+func (cl *Client) encoding() c.Codec {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.codec
+}
+
+func (cl *Client) redial() *ws.Conn {
+	backoff := cl.opts.MinBackoff
+	for {
+		select {
+		case <-cl.ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, err := cl.dial()
+		if err == nil {
+			cl.mu.Lock()
+			cl.conn = conn
+			cl.mu.Unlock()
+			return conn
+		}
+		backoff = min(backoff*2, cl.opts.MaxBackoff)
+	}
+}
+
+func (cl *Client) publish(ev Event) {
+	cl.mu.Lock()
+	subs := cl.subs
+	cl.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- ev:
+		case <-cl.ctx.Done():
+			return
+		}
+	}
+}
+
+func (cl *Client) finish() {
+	cl.stop()
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for _, ch := range cl.subs {
+		close(ch)
+	}
+	cl.subs = nil
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"strings"
+
+	c "go-chat/common"
+)
+
+// DefaultCommands are used until the server sends its list of commands, or if
+// it is too old to send one.
+var DefaultCommands = []c.Command{
+	{Name: "mv", Args: "<nick>", Help: "set your nick", Typ: c.Mv},
+	{Name: "ls", Help: "get the available rooms", Typ: c.Ls},
+	{Name: "cd", Args: "<room>", Help: "connect to a room", Typ: c.Cd},
+	{Name: "who", Help: "list users in the current room", Typ: c.Who},
+	{Name: "sudo", Args: "<command>", Help: "run an admin command", Perm: "admin", Typ: c.Sudo},
+}
+
+// Parse turns a line of input into a message for the server using the
+// commands it sent, or DefaultCommands. Lines starting with / are commands,
+// e.g. "/cd general", anything else is sent to the room. It returns false for
+// empty lines and unknown commands.
+func (cl *Client) Parse(line string) (c.CMsg, bool) {
+	return parse(cl.Commands(), line)
+}
+
+// Commands returns the commands available on the server, DefaultCommands
+// until it sends them after connecting.
+func (cl *Client) Commands() []c.Command {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.cmds
+}
+
+func parse(cmds []c.Command, line string) (c.CMsg, bool) {
+	line = strings.TrimSpace(line)
+	text, ok := strings.CutPrefix(line, "/")
+	if !ok {
+		return c.CMsg{Typ: c.Echo, Msg: line}, line != ""
+	}
+
+	name, rest, hasArgs := strings.Cut(text, " ")
+	for _, cmd := range cmds {
+		if cmd.Name != name {
+			continue
+		}
+		// arguments in [brackets] are optional
+		if hasArgs && cmd.Args == "" || !hasArgs && cmd.Args != "" && !strings.HasPrefix(cmd.Args, "[") {
+			return c.CMsg{}, false
+		}
+		if cmd.Typ == c.Cmd {
+			return c.CMsg{Typ: c.Cmd, Msg: text}, true
+		}
+		return c.CMsg{Typ: cmd.Typ, Msg: rest}, true
+	}
+	return c.CMsg{}, false
+}
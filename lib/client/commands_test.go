@@ -0,0 +1,48 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+)
+
+// TestDefaultCommands connects to a server which does not negotiate a
+// subprotocol, like servers before it, so it never sends its commands.
+func TestDefaultCommands(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ws.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			if _, _, err := conn.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	cl, err := Connect(t.Context(), ts.Listener.Addr().String(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if _, ok := cl.Hello(); ok {
+		t.Fatal("hello from a server without a subprotocol")
+	}
+
+	if cmsg, ok := cl.Parse("/cd general"); !ok || cmsg.Typ != c.Cd || cmsg.Msg != "general" {
+		t.Errorf("/cd general parsed as %+v, %v", cmsg, ok)
+	}
+	if cmsg, ok := cl.Parse("/mv alice"); !ok || cmsg.Typ != c.Mv || cmsg.Msg != "alice" {
+		t.Errorf("/mv alice parsed as %+v, %v", cmsg, ok)
+	}
+	if _, ok := cl.Parse("/pin 1"); ok {
+		t.Error("/pin parsed without the server commands")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	c "go-chat/common"
+)
+
+type apiConn struct {
+	Nick string `json:"nick"`
+	Room string `json:"room"`
+	Addr string `json:"addr"`
+	Auth bool   `json:"auth"`
+	// Latency is the last keepalive round trip time.
+	Latency string `json:"latency,omitempty"`
+}
+
+type apiRoom struct {
+	Name     string `json:"name"`
+	Users    int    `json:"users"`
+	Messages int64  `json:"messages"`
+	Ttl      string `json:"ttl,omitempty"`
+}
+
+type apiUser struct {
+	Nick       string `json:"nick"`
+	Registered bool   `json:"registered"`
+	Online     bool   `json:"online"`
+	Banned     bool   `json:"banned"`
+}
+
+type apiRequest struct {
+	Name   string `json:"name"`
+	Nick   string `json:"nick"`
+	Room   string `json:"room"`
+	Msg    string `json:"msg"`
+	Reason string `json:"reason"`
+	Url    string `json:"url"`
+	Events string `json:"events"`
+}
+
+func (s server) apiRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/connections", s.apiConnections)
+	mux.HandleFunc("GET /api/rooms", s.apiRooms)
+	mux.HandleFunc("POST /api/rooms", s.apiMkRoom)
+	mux.HandleFunc("DELETE /api/rooms/{room}", s.apiRmRoom)
+	mux.HandleFunc("GET /api/rooms/{room}/messages", s.apiMessages)
+	mux.HandleFunc("GET /api/users", s.apiUsers)
+	mux.HandleFunc("POST /api/kick", s.apiKick)
+	mux.HandleFunc("GET /api/bans", s.apiBans)
+	mux.HandleFunc("POST /api/bans", s.apiBan)
+	mux.HandleFunc("DELETE /api/bans/{nick}", s.apiUnban)
+	mux.HandleFunc("POST /api/announce", s.apiAnnounce)
+	mux.HandleFunc("GET /api/webhooks", s.apiWebhooks)
+	mux.HandleFunc("POST /api/webhooks", s.apiAddWebhook)
+	mux.HandleFunc("DELETE /api/webhooks/{id}", s.apiRmWebhook)
+	mux.HandleFunc("GET /api/webhooks/{id}/deliveries", s.apiDeliveries)
+	mux.HandleFunc("GET /api/links", s.apiLinks)
+	return s.apiAuth(mux)
+}
+
+func (s server) apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.cfg().token
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			s.log.Warn("api unauthorized", "addr", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		s.log.Debug("api", "addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	apiJSON(w, status, map[string]string{"error": msg})
+}
+
+func apiRoomError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRoomMissing):
+		apiError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errRoomExists):
+		apiError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errRoomInvalid):
+		apiError(w, http.StatusBadRequest, err.Error())
+	default:
+		apiError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func readRequest(w http.ResponseWriter, r *http.Request) (apiRequest, bool) {
+	req := apiRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return req, false
+	}
+	return req, true
+}
+
+func (s server) apiConnections(w http.ResponseWriter, r *http.Request) {
+	s.conns.sm.Lock()
+	list := []apiConn{}
+	for _, u := range s.conns.cm {
+		conn := apiConn{Nick: u.nick, Room: u.room, Addr: u.addr, Auth: u.auth}
+		if u.rtt > 0 {
+			conn.Latency = u.rtt.String()
+		}
+		list = append(list, conn)
+	}
+	s.conns.sm.Unlock()
+
+	slices.SortFunc(list, func(a, b apiConn) int { return strings.Compare(a.Nick, b.Nick) })
+	apiJSON(w, http.StatusOK, list)
+}
+
+func (s server) apiRooms(w http.ResponseWriter, r *http.Request) {
+	names := s.roomNames()
+	list := make([]apiRoom, 0, len(names))
+
+	s.conns.sm.Lock()
+	users := make(map[string]int)
+	for _, u := range s.conns.cm {
+		users[u.room]++
+	}
+	for _, name := range names {
+		room := apiRoom{Name: name, Users: users[name], Messages: s.rnums[name]}
+		if ttl := s.rttls[name]; ttl > 0 {
+			room.Ttl = ttl.String()
+		}
+		list = append(list, room)
+	}
+	s.conns.sm.Unlock()
+
+	apiJSON(w, http.StatusOK, list)
+}
+
+func (s server) apiMkRoom(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.mkRoom(req.Name); err != nil {
+		apiRoomError(w, err)
+		return
+	}
+	s.audit("api", "mk", req.Name, "")
+	apiJSON(w, http.StatusCreated, apiRoom{Name: req.Name})
+}
+
+func (s server) apiRmRoom(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+	if err := s.rmRoom(r.Context(), room); err != nil {
+		apiRoomError(w, err)
+		return
+	}
+	s.audit("api", "rm", room, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s server) apiMessages(w http.ResponseWriter, r *http.Request) {
+	limit, before := s.rhlen, int64(0)
+	var err error
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 1000 {
+			apiError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+	}
+	if v := r.URL.Query().Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			apiError(w, http.StatusBadRequest, "before must be a message id")
+			return
+		}
+	}
+
+	msgs, err := s.history(r.PathValue("room"), before, limit)
+	if err != nil {
+		apiRoomError(w, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, msgs)
+}
+
+func (s server) apiUsers(w http.ResponseWriter, r *http.Request) {
+	users := make(map[string]apiUser)
+	for nick := range s.cfg().nickm {
+		users[nick] = apiUser{Nick: nick, Registered: true}
+	}
+
+	s.conns.sm.Lock()
+	for _, u := range s.conns.cm {
+		user := users[u.nick]
+		user.Nick = u.nick
+		user.Online = true
+		users[u.nick] = user
+	}
+	s.conns.sm.Unlock()
+
+	bans, err := s.bans()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, b := range bans {
+		user := users[b.Nick]
+		user.Nick = b.Nick
+		user.Banned = true
+		users[b.Nick] = user
+	}
+
+	list := make([]apiUser, 0, len(users))
+	for _, nick := range slices.Sorted(maps.Keys(users)) {
+		list = append(list, users[nick])
+	}
+	apiJSON(w, http.StatusOK, list)
+}
+
+func (s server) apiKick(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "Kicked"
+	}
+	if !s.kick(req.Nick, reason) {
+		apiError(w, http.StatusNotFound, "not connected: "+req.Nick)
+		return
+	}
+	s.audit("api", "yeet", req.Nick, req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s server) apiBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.bans()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiJSON(w, http.StatusOK, bans)
+}
+
+func (s server) apiBan(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Nick == "" || !alphanumeric(req.Nick) {
+		apiError(w, http.StatusBadRequest, "invalid nick: "+req.Nick)
+		return
+	}
+	if err := s.ban(req.Nick, req.Reason); err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.audit("api", "ban", req.Nick, req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s server) apiUnban(w http.ResponseWriter, r *http.Request) {
+	nick := r.PathValue("nick")
+	found, err := s.unban(nick)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		apiError(w, http.StatusNotFound, "not banned: "+nick)
+		return
+	}
+	s.audit("api", "unban", nick, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s server) apiAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Msg == "" {
+		apiError(w, http.StatusBadRequest, "msg is required")
+		return
+	}
+	rooms := s.roomNames()
+	if req.Room != "" {
+		if !s.hasRoom(req.Room) {
+			apiRoomError(w, fmt.Errorf("%w: %v", errRoomMissing, req.Room))
+			return
+		}
+		rooms = []string{req.Room}
+	}
+
+	smsg := c.SMsg{Tim: time.Now(), Id: "system", Msg: req.Msg, Typ: c.Announce}
+	for _, room := range rooms {
+		s.broadcast(r.Context(), room, smsg)
+	}
+	s.audit("api", "announce", req.Room, s.body(req.Msg))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s server) apiWebhooks(w http.ResponseWriter, r *http.Request) {
+	list := s.hooks.all()
+	for i := range list {
+		list[i].Secret = ""
+	}
+	apiJSON(w, http.StatusOK, list)
+}
+
+func (s server) apiAddWebhook(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.hasRoom(req.Room) {
+		apiRoomError(w, fmt.Errorf("%w: %v", errRoomMissing, req.Room))
+		return
+	}
+	h, err := s.hooks.add(req.Room, req.Events, req.Url)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.audit("api", "webhook", h.Room, fmt.Sprintf("%v %v %v", h.Id, h.Events, h.Url))
+	apiJSON(w, http.StatusCreated, h)
+}
+
+func (s server) apiRmWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+
+	found, err := s.hooks.remove(id)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		apiError(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+	s.audit("api", "rmwebhook", r.PathValue("id"), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s server) apiDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+
+	list, err := s.hooks.deliveries(id, 100)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiJSON(w, http.StatusOK, list)
+}
+
+func (s server) apiLinks(w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, s.links.all())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const createAuditTable = "CREATE TABLE IF NOT EXISTS audit (tim DATETIME, nick TEXT, action TEXT, target TEXT, detail TEXT)"
+const auditNoUpdate = "CREATE TRIGGER IF NOT EXISTS audit_no_update BEFORE UPDATE ON audit BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END"
+const auditNoDelete = "CREATE TRIGGER IF NOT EXISTS audit_no_delete BEFORE DELETE ON audit BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END"
+
+type auditEntry struct {
+	Tim    time.Time `json:"tim"`
+	Nick   string    `json:"nick"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func (s server) audit(nick string, action string, target string, detail string) {
+	s.log.Info("audit", "nick", nick, "action", action, "target", target, "detail", detail)
+	_, err := s.dbase.Exec("INSERT INTO audit (tim, nick, action, target, detail) VALUES ($1, $2, $3, $4, $5)", time.Now(), nick, action, target, detail)
+	if err != nil {
+		s.log.Error("audit", "err", err)
+	}
+}
+
+func (s server) auditText(n int) string {
+	entries := []auditEntry{}
+	err := s.dbase.Select(&entries, "SELECT * FROM (SELECT * FROM audit ORDER BY tim DESC LIMIT $1) ORDER BY tim", n)
+	if err != nil {
+		return fmt.Sprintf("Failed: %v", err)
+	}
+	if len(entries) == 0 {
+		return "Audit log is empty"
+	}
+
+	text := "Recent audit log:"
+	for _, e := range entries {
+		text += fmt.Sprintf("\n  %v %v %v %v %v", e.Tim.Format(time.DateTime), e.Nick, e.Action, e.Target, e.Detail)
+	}
+	return text
+}
+
+func (s server) body(msg string) string {
+	if s.cfg().redact {
+		return fmt.Sprintf("[redacted, %v bytes]", len(msg))
+	}
+	return msg
+}
+
+func exportAudit(dbPath string, path string) error {
+	db, err := sqlx.Connect("sqlite", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(createAuditTable)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	rows, err := db.Queryx("SELECT * FROM audit ORDER BY tim")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		e := auditEntry{}
+		if err := rows.StructScan(&e); err != nil {
+			return err
+		}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	c "go-chat/common"
+)
+
+const (
+	backplaneQueue   = 1024
+	backplaneTimeout = 5 * time.Second
+)
+
+// backplane connects server instances sharing a database, so that several of
+// them behind a load balancer act as one server. Messages are numbered and
+// fanned out through it, and nicks are unique across all instances.
+type backplane interface {
+	// next returns the next message number in room, after at least num.
+	next(room string, num int64) int64
+	// publish sends ev to the other instances.
+	publish(ev bpEvent)
+	// events returns the events published by the other instances.
+	events() <-chan bpEvent
+	// claim reserves nick for this instance, it returns false if another
+	// instance is using it.
+	claim(nick string) bool
+	release(nick string)
+	// setUsers replaces the users in each room on this instance.
+	setUsers(users map[string][]string)
+	// users returns the users in room on the other instances.
+	users(room string) []string
+	close()
+}
+
+// bpEvent is a change made by one instance that the others apply. Msg events
+// are broadcast to the room, mk and rm events create and delete rooms.
+type bpEvent struct {
+	Kind string  `json:"kind"`
+	Room string  `json:"room"`
+	Msg  *c.SMsg `json:"msg,omitempty"`
+}
+
+// hub is the in-process backplane. A single server uses it on its own, and it
+// can be shared with other instances over TCP with serveHub.
+type hub struct {
+	mu      sync.Mutex
+	nums    map[string]int64
+	nicks   map[string]*member
+	members map[*member]struct{}
+}
+
+// member is an instance connected to a hub.
+type member struct {
+	hub *hub
+	ch  chan bpEvent
+	// users in each room on the instance, guarded by hub.mu
+	rooms map[string][]string
+}
+
+func newHub() *hub {
+	return &hub{
+		nums:    make(map[string]int64),
+		nicks:   make(map[string]*member),
+		members: make(map[*member]struct{}),
+	}
+}
+
+func (h *hub) join() *member {
+	m := &member{hub: h, ch: make(chan bpEvent, backplaneQueue), rooms: make(map[string][]string)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.members[m] = struct{}{}
+	return m
+}
+
+func (m *member) next(room string, num int64) int64 {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	n := max(m.hub.nums[room], num) + 1
+	m.hub.nums[room] = n
+	return n
+}
+
+// publish drops events for instances that fall behind rather than blocking
+// the others.
+func (m *member) publish(ev bpEvent) {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	for o := range m.hub.members {
+		if o == m {
+			continue
+		}
+		select {
+		case o.ch <- ev:
+		default:
+		}
+	}
+}
+
+func (m *member) events() <-chan bpEvent {
+	return m.ch
+}
+
+func (m *member) claim(nick string) bool {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	if owner, ok := m.hub.nicks[nick]; ok && owner != m {
+		return false
+	}
+	m.hub.nicks[nick] = m
+	return true
+}
+
+func (m *member) release(nick string) {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	if m.hub.nicks[nick] == m {
+		delete(m.hub.nicks, nick)
+	}
+}
+
+func (m *member) setUsers(users map[string][]string) {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	m.rooms = users
+}
+
+func (m *member) users(room string) []string {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	users := []string{}
+	for o := range m.hub.members {
+		if o != m {
+			users = append(users, o.rooms[room]...)
+		}
+	}
+	return users
+}
+
+// close removes the instance with its nicks and users.
+func (m *member) close() {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	if _, ok := m.hub.members[m]; !ok {
+		return
+	}
+	delete(m.hub.members, m)
+	for nick, owner := range m.hub.nicks {
+		if owner == m {
+			delete(m.hub.nicks, nick)
+		}
+	}
+	close(m.ch)
+}
+
+// bpRequest is sent by instances to a hub over TCP as a line of JSON. The hub
+// replies with a bpResponse with the same id, and sends events with id 0.
+type bpRequest struct {
+	Id    int64               `json:"id"`
+	Op    string              `json:"op"`
+	Room  string              `json:"room,omitempty"`
+	Num   int64               `json:"num,omitempty"`
+	Nick  string              `json:"nick,omitempty"`
+	Users map[string][]string `json:"users,omitempty"`
+	Event *bpEvent            `json:"event,omitempty"`
+}
+
+type bpResponse struct {
+	Id    int64    `json:"id"`
+	Num   int64    `json:"num,omitempty"`
+	Ok    bool     `json:"ok,omitempty"`
+	Users []string `json:"users,omitempty"`
+	Event *bpEvent `json:"event,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// serveHub shares h with instances connecting to l, until l is closed.
+func serveHub(l net.Listener, h *hub, log *slog.Logger) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error("backplane accept failed", "err", err)
+			}
+			return
+		}
+		go serveMember(conn, h, log)
+	}
+}
+
+func serveMember(conn net.Conn, h *hub, log *slog.Logger) {
+	defer conn.Close()
+	m := h.join()
+	defer m.close()
+	log.Info("backplane instance joined", "addr", conn.RemoteAddr())
+
+	mu := sync.Mutex{}
+	enc := json.NewEncoder(conn)
+	send := func(resp bpResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(resp); err != nil {
+			conn.Close()
+		}
+	}
+	go func() {
+		for ev := range m.ch {
+			send(bpResponse{Event: &ev})
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		req := bpRequest{}
+		if err := dec.Decode(&req); err != nil {
+			log.Info("backplane instance left", "addr", conn.RemoteAddr(), "err", err)
+			return
+		}
+
+		resp := bpResponse{Id: req.Id}
+		switch req.Op {
+		case "next":
+			resp.Num = m.next(req.Room, req.Num)
+		case "publish":
+			if req.Event != nil {
+				m.publish(*req.Event)
+			}
+		case "claim":
+			resp.Ok = m.claim(req.Nick)
+		case "release":
+			m.release(req.Nick)
+		case "users":
+			resp.Users = m.users(req.Room)
+		case "presence":
+			m.setUsers(req.Users)
+		default:
+			resp.Error = fmt.Sprintf("unknown op: %v", req.Op)
+		}
+		if req.Id != 0 {
+			send(resp)
+		}
+	}
+}
+
+var errBackplaneDown = errors.New("backplane unavailable")
+
+// tcpBackplane is an instance connected to a hub served by another instance.
+// It reconnects when the connection drops, claiming its nicks and sending its
+// users again. While disconnected it numbers messages on its own and allows
+// any nick, so the instance keeps working on its own.
+type tcpBackplane struct {
+	addr string
+	log  *slog.Logger
+	ch   chan bpEvent
+	stop chan struct{}
+
+	mu      sync.Mutex
+	conn    net.Conn
+	enc     *json.Encoder
+	id      int64
+	pending map[int64]chan bpResponse
+	nicks   map[string]struct{}
+	rooms   map[string][]string
+}
+
+func dialBackplane(addr string, log *slog.Logger) *tcpBackplane {
+	b := &tcpBackplane{
+		addr:    addr,
+		log:     log,
+		ch:      make(chan bpEvent, backplaneQueue),
+		stop:    make(chan struct{}),
+		pending: make(map[int64]chan bpResponse),
+		nicks:   make(map[string]struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *tcpBackplane) run() {
+	backoff := time.Second
+	for {
+		conn, err := net.DialTimeout("tcp", b.addr, backplaneTimeout)
+		if err == nil {
+			backoff = time.Second
+			b.log.Info("backplane connected", "addr", b.addr)
+			err = b.serve(conn)
+		}
+
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		b.log.Warn("backplane disconnected, reconnecting", "addr", b.addr, "in", backoff, "err", err)
+
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// serve reads responses and events from conn until it closes.
+func (b *tcpBackplane) serve(conn net.Conn) error {
+	defer conn.Close()
+	b.mu.Lock()
+	b.conn, b.enc = conn, json.NewEncoder(conn)
+	nicks := slices.Collect(maps.Keys(b.nicks))
+	rooms := b.rooms
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.conn, b.enc = nil, nil
+		for id, ch := range b.pending {
+			close(ch)
+			delete(b.pending, id)
+		}
+		b.mu.Unlock()
+	}()
+
+	// restore the nicks and users held before reconnecting, without waiting
+	// for the replies
+	for _, nick := range nicks {
+		b.send(bpRequest{Op: "claim", Nick: nick})
+	}
+	if rooms != nil {
+		b.send(bpRequest{Op: "presence", Users: rooms})
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		resp := bpResponse{}
+		if err := dec.Decode(&resp); err != nil {
+			return err
+		}
+
+		if resp.Event != nil {
+			// never block, a request may be waiting on the next response
+			select {
+			case b.ch <- *resp.Event:
+			default:
+				b.log.Warn("backplane event dropped", "kind", resp.Event.Kind, "room", resp.Event.Room)
+			}
+			continue
+		}
+
+		b.mu.Lock()
+		ch, ok := b.pending[resp.Id]
+		delete(b.pending, resp.Id)
+		b.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// send writes req without waiting for a reply.
+func (b *tcpBackplane) send(req bpRequest) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.enc == nil {
+		return errBackplaneDown
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(backplaneTimeout))
+	return b.enc.Encode(req)
+}
+
+// do sends req and waits for the reply.
+func (b *tcpBackplane) do(req bpRequest) (bpResponse, error) {
+	b.mu.Lock()
+	if b.enc == nil {
+		b.mu.Unlock()
+		return bpResponse{}, errBackplaneDown
+	}
+	b.id++
+	req.Id = b.id
+	ch := make(chan bpResponse, 1)
+	b.pending[req.Id] = ch
+	b.conn.SetWriteDeadline(time.Now().Add(backplaneTimeout))
+	err := b.enc.Encode(req)
+	if err != nil {
+		delete(b.pending, req.Id)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return bpResponse{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return bpResponse{}, errBackplaneDown
+		}
+		if resp.Error != "" {
+			return resp, errors.New(resp.Error)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		delete(b.pending, req.Id)
+		b.mu.Unlock()
+		return bpResponse{}, ctx.Err()
+	}
+}
+
+func (b *tcpBackplane) next(room string, num int64) int64 {
+	resp, err := b.do(bpRequest{Op: "next", Room: room, Num: num})
+	if err != nil {
+		b.log.Warn("backplane numbering failed, numbering locally", "room", room, "err", err)
+		return num + 1
+	}
+	return resp.Num
+}
+
+func (b *tcpBackplane) publish(ev bpEvent) {
+	if err := b.send(bpRequest{Op: "publish", Event: &ev}); err != nil {
+		b.log.Warn("backplane publish failed", "kind", ev.Kind, "room", ev.Room, "err", err)
+	}
+}
+
+func (b *tcpBackplane) events() <-chan bpEvent {
+	return b.ch
+}
+
+func (b *tcpBackplane) claim(nick string) bool {
+	resp, err := b.do(bpRequest{Op: "claim", Nick: nick})
+	if err != nil {
+		b.log.Warn("backplane claim failed, allowing nick", "nick", nick, "err", err)
+	} else if !resp.Ok {
+		return false
+	}
+	b.mu.Lock()
+	b.nicks[nick] = struct{}{}
+	b.mu.Unlock()
+	return true
+}
+
+func (b *tcpBackplane) release(nick string) {
+	b.mu.Lock()
+	_, ok := b.nicks[nick]
+	delete(b.nicks, nick)
+	b.mu.Unlock()
+	if ok {
+		b.send(bpRequest{Op: "release", Nick: nick})
+	}
+}
+
+func (b *tcpBackplane) setUsers(users map[string][]string) {
+	b.mu.Lock()
+	b.rooms = users
+	b.mu.Unlock()
+	b.send(bpRequest{Op: "presence", Users: users})
+}
+
+func (b *tcpBackplane) users(room string) []string {
+	resp, err := b.do(bpRequest{Op: "users", Room: room})
+	if err != nil {
+		return []string{}
+	}
+	return resp.Users
+}
+
+func (b *tcpBackplane) close() {
+	close(b.stop)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+// share publishes the users in each room on this instance when they change,
+// until ctx is done.
+func (s server) share(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last map[string][]string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		users := make(map[string][]string)
+		s.conns.sm.Lock()
+		for _, u := range s.conns.cm {
+			users[u.room] = append(users[u.room], u.nick)
+		}
+		s.conns.sm.Unlock()
+		for room := range users {
+			slices.Sort(users[room])
+		}
+
+		if !mapsEqual(users, last) {
+			s.bplane.setUsers(users)
+			last = users
+		}
+	}
+}
+
+func mapsEqual(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !slices.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply makes the changes published by other instances until the backplane
+// closes.
+func (s server) apply(ctx context.Context) {
+	for ev := range s.bplane.events() {
+		switch ev.Kind {
+		case "msg":
+			if ev.Msg == nil || !s.hasRoom(ev.Room) {
+				continue
+			}
+			smsg := *ev.Msg
+			s.conns.sm.Lock()
+			i := slices.IndexFunc(s.rhist[ev.Room], func(m c.SMsg) bool { return m.Num == smsg.Num })
+			switch {
+			case smsg.Typ == c.Expire:
+				if i >= 0 {
+					s.rhist[ev.Room] = slices.Delete(slices.Clone(s.rhist[ev.Room]), i, i+1)
+				}
+			case smsg.Num > 0 && i >= 0:
+				s.rhist[ev.Room][i] = smsg
+			case smsg.Num > s.rnums[ev.Room]:
+				s.rnums[ev.Room] = smsg.Num
+				if len(s.rhist[ev.Room]) < s.rhlen {
+					s.rhist[ev.Room] = append(s.rhist[ev.Room], smsg)
+				} else {
+					s.rhist[ev.Room] = append(s.rhist[ev.Room][1:], smsg)
+				}
+			}
+			s.conns.sm.Unlock()
+			s.deliver(ctx, ev.Room, smsg)
+		case "mk":
+			var num int64
+			err := s.dbase.Get(&num, fmt.Sprintf(selectRoomNum, ev.Room))
+			if err != nil {
+				s.log.Error("backplane room", "room", ev.Room, "err", err)
+				continue
+			}
+			s.addRoom(ev.Room, num)
+		case "rm":
+			if s.hasRoom(ev.Room) {
+				s.dropRoom(ctx, ev.Room)
+			}
+		}
+	}
+}
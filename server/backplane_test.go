@@ -0,0 +1,101 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+)
+
+// releases records the nicks an instance releases.
+type releases struct {
+	backplane
+	mu    sync.Mutex
+	nicks []string
+}
+
+func (r *releases) release(nick string) {
+	r.mu.Lock()
+	r.nicks = append(r.nicks, nick)
+	r.mu.Unlock()
+	r.backplane.release(nick)
+}
+
+// wait waits until nick was released.
+func (r *releases) wait(t *testing.T, nick string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		ok := slices.Contains(r.nicks, nick)
+		r.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v was not released", nick)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitConns waits until s has n connections.
+func waitConns(t *testing.T, s server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.conns.sm.Lock()
+		l := len(s.conns.cm)
+		s.conns.sm.Unlock()
+		if l == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v connections, want %v", l, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNickClaims(t *testing.T) {
+	h := newHub()
+	rel := &releases{backplane: h.join()}
+	a, tsA := testInstance(t, rel)
+	_, tsB := testInstance(t, h.join())
+
+	alice := dialTest(t, tsA.URL)
+	alice.send(c.Mv, "alice")
+	if m := alice.wait(func(m c.SMsg) bool { return m.Typ == c.Nick }); m.Num != c.Done {
+		t.Fatalf("mv alice: result %v", m.Num)
+	}
+
+	bob := dialTest(t, tsB.URL)
+	bob.send(c.Mv, "alice")
+	if m := bob.wait(func(m c.SMsg) bool { return m.Typ == c.Nick }); m.Num != c.NickUsed {
+		t.Fatalf("mv alice on another instance: result %v", m.Num)
+	}
+
+	// guests keep their port as nick, it was never claimed
+	guest := dialTest(t, tsA.URL)
+	guest.conn.Close(ws.StatusNormalClosure, "")
+	waitConns(t, a, 1)
+	alice.send(c.Mv, "alice2")
+	alice.wait(func(m c.SMsg) bool { return m.Typ == c.Nick })
+	rel.wait(t, "alice")
+	alice.conn.Close(ws.StatusNormalClosure, "")
+	rel.wait(t, "alice2")
+	rel.mu.Lock()
+	if len(rel.nicks) != 2 {
+		t.Errorf("released %v, want alice and alice2", rel.nicks)
+	}
+	rel.mu.Unlock()
+
+	bob.send(c.Mv, "alice")
+	if m := bob.wait(func(m c.SMsg) bool { return m.Typ == c.Nick }); m.Num != c.Done {
+		t.Errorf("mv alice after it was released: result %v", m.Num)
+	}
+}
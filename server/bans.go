@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+const createBansTable = "CREATE TABLE IF NOT EXISTS bans (nick TEXT PRIMARY KEY, reason TEXT, tim DATETIME)"
+
+type ban struct {
+	Nick   string    `json:"nick"`
+	Reason string    `json:"reason,omitempty"`
+	Tim    time.Time `json:"tim"`
+}
+
+func (s server) banned(nick string) bool {
+	var n int
+	if err := s.dbase.Get(&n, "SELECT COUNT(*) FROM bans WHERE nick = $1", nick); err != nil {
+		s.log.Error("banned", "nick", nick, "err", err)
+		return false
+	}
+	return n > 0
+}
+
+func (s server) ban(nick string, reason string) error {
+	_, err := s.dbase.Exec("INSERT OR REPLACE INTO bans (nick, reason, tim) VALUES ($1, $2, $3)", nick, reason, time.Now())
+	if err != nil {
+		return err
+	}
+	s.kick(nick, "Banned")
+	return nil
+}
+
+func (s server) unban(nick string) (bool, error) {
+	res, err := s.dbase.Exec("DELETE FROM bans WHERE nick = $1", nick)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s server) bans() ([]ban, error) {
+	bans := []ban{}
+	err := s.dbase.Select(&bans, "SELECT nick, reason, tim FROM bans ORDER BY nick")
+	return bans, err
+}
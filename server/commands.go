@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	c "go-chat/common"
+)
+
+const (
+	permAny   = ""
+	permAuth  = "auth"
+	permOp    = "op"
+	permAdmin = "admin"
+)
+
+// cmdFunc runs a plugin command for u, args is the text after the command
+// name. The reply is sent to u as a system message if it is not empty.
+type cmdFunc func(ctx context.Context, s server, u user, args string) (string, error)
+
+// filterFunc is called before a message is posted to room, it can change the
+// message or return false to drop it.
+type filterFunc func(ctx context.Context, s server, room string, smsg *c.SMsg) bool
+
+// listenFunc is called after a message is posted to room.
+type listenFunc func(ctx context.Context, s server, room string, smsg c.SMsg)
+
+type command struct {
+	c.Command
+	run cmdFunc
+}
+
+// builtins are handled in ServeHTTP, they are registered so clients can list
+// them with Cmds.
+var builtins = []c.Command{
+	{Name: "mv", Args: "<nick>", Help: "set your nick, with :password if registered", Typ: c.Mv},
+	{Name: "ls", Help: "get the available rooms", Typ: c.Ls},
+	{Name: "cd", Args: "<room>", Help: "connect to a room", Typ: c.Cd},
+	{Name: "who", Help: "list users in the current room", Typ: c.Who},
+	{Name: "pin", Args: "<id>", Help: "pin a message in the current room", Perm: permOp, Typ: c.Pin},
+	{Name: "unpin", Args: "<id>", Help: "unpin a message in the current room", Perm: permOp, Typ: c.Unpin},
+	{Name: "pins", Help: "list pinned messages in the current room", Typ: c.Pins},
+	{Name: "me", Args: "<message>", Help: "send an action, e.g. /me waves", Typ: c.Me},
+	{Name: "notice", Args: "<message>", Help: "send a notice to the current room", Typ: c.Notice},
+	{Name: "ttl", Args: "<duration> <message>", Help: "send a message that expires, e.g. /ttl 5m hunter2", Typ: c.Temp},
+	{Name: "poll", Args: "\"<question>\" <option> <option>...", Help: "start a poll in the current room", Typ: c.NewPoll},
+	{Name: "vote", Args: "<id> <n>", Help: "vote for option n in a poll", Perm: permAuth, Typ: c.Vote},
+	{Name: "closepoll", Args: "<id>", Help: "close a poll (registered poll creator or operators only)", Typ: c.ClosePoll},
+	{Name: "sudo", Args: "<command>", Help: "run an admin command, /sudo man for more info", Perm: permAdmin, Typ: c.Sudo},
+}
+
+// sudoCommands are the admin commands run with /sudo, handled in ServeHTTP.
+var sudoCommands = []c.Command{
+	{Name: "mk", Args: "<room>", Help: "create a room"},
+	{Name: "rm", Args: "<room>", Help: "delete a room and its history"},
+	{Name: "yeet", Args: "<nick>", Help: "disconnect a user"},
+	{Name: "ban", Args: "<nick>", Help: "ban a nick and disconnect it"},
+	{Name: "unban", Args: "<nick>", Help: "lift a ban"},
+	{Name: "ttl", Args: "<room> <duration|off>", Help: "set the default message ttl in a room, in whole seconds, e.g. 30s or 1h"},
+	{Name: "op", Args: "<room> <nick>", Help: "make a nick operator in a room"},
+	{Name: "deop", Args: "<room> <nick>", Help: "remove an operator from a room"},
+	{Name: "hook", Args: "<room> <name>", Help: "create an incoming webhook posting to a room"},
+	{Name: "hooks", Help: "list incoming webhooks"},
+	{Name: "unhook", Args: "<token>", Help: "delete an incoming webhook"},
+	{Name: "webhook", Args: "<room> <events> <url>", Help: "create an outgoing webhook for message, join or match:<keyword> events"},
+	{Name: "webhooks", Help: "list outgoing webhooks"},
+	{Name: "rmwebhook", Args: "<id>", Help: "delete an outgoing webhook"},
+	{Name: "deliveries", Args: "<id>", Help: "list recent deliveries of an outgoing webhook"},
+	{Name: "wc", Help: "count connected users"},
+	{Name: "audit", Help: "list recent privileged actions"},
+	{Name: "man", Help: "prints this message"},
+}
+
+var plugins struct {
+	cmds      []command
+	filters   []filterFunc
+	listeners []listenFunc
+}
+
+// registerCommand adds a command for plugins, usually from an init function.
+// Commands are sent by clients as Cmd messages and run if u has perm.
+func registerCommand(name string, args string, help string, perm string, run cmdFunc) {
+	if slices.ContainsFunc(builtins, func(b c.Command) bool { return b.Name == name }) || findCommand(name) != nil {
+		panic(fmt.Sprintf("command already registered: %v", name))
+	}
+	plugins.cmds = append(plugins.cmds, command{c.Command{Name: name, Args: args, Help: help, Perm: perm, Typ: c.Cmd}, run})
+}
+
+// registerFilter adds a filter for posted messages, usually from an init
+// function. Filters run in the order they are registered.
+func registerFilter(f filterFunc) {
+	plugins.filters = append(plugins.filters, f)
+}
+
+// registerListener adds a listener for posted messages, usually from an init
+// function, e.g. for bots.
+func registerListener(f listenFunc) {
+	plugins.listeners = append(plugins.listeners, f)
+}
+
+func findCommand(name string) *command {
+	for i := range plugins.cmds {
+		if plugins.cmds[i].Name == name {
+			return &plugins.cmds[i]
+		}
+	}
+	return nil
+}
+
+func commandList() string {
+	list := slices.Clone(builtins)
+	for _, cmd := range plugins.cmds {
+		list = append(list, cmd.Command)
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+// sudoManText lists the /sudo commands and the admin commands of plugins.
+func sudoManText() string {
+	text := "Admin commands, run with /sudo:"
+	for _, cmd := range sudoCommands {
+		text += "\n  " + strings.TrimSpace(cmd.Name+" "+cmd.Args) + "\n    " + cmd.Help
+	}
+	header := "\nAdmin commands from plugins:"
+	for _, cmd := range plugins.cmds {
+		if cmd.Perm == permAdmin {
+			text += header + "\n  " + strings.TrimSpace(cmd.Name+" "+cmd.Args) + "\n    " + cmd.Help
+			header = ""
+		}
+	}
+	return text
+}
+
+func (s server) allowed(u user, perm string) bool {
+	switch perm {
+	case permAny:
+		return true
+	case permAuth:
+		return u.auth
+	case permOp:
+		return s.isOp(u, u.room)
+	default:
+		// like isOp, the admin nick is only trusted once registered
+		return u.auth && u.nick == s.cfg().admin
+	}
+}
+
+func (s server) runCommand(ctx context.Context, u user, msg string) (string, error) {
+	name, args, _ := strings.Cut(msg, " ")
+	cmd := findCommand(name)
+	if cmd == nil {
+		return "", fmt.Errorf("unrecognised command: %v, use /man for more info", name)
+	}
+	if !s.allowed(u, cmd.Perm) {
+		s.log.Warn("command denied", "nick", u.nick, "cmd", name)
+		return "", fmt.Errorf("permission denied: %v requires %v", name, cmd.Perm)
+	}
+
+	s.log.Info("command", "nick", u.nick, "cmd", name)
+	return cmd.run(ctx, s, u, strings.TrimSpace(args))
+}
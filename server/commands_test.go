@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+)
+
+// TestSudoCommands checks that every command listed by /sudo man is handled.
+func TestSudoCommands(t *testing.T) {
+	_, ts := testServer(t)
+	admin := dialTest(t, ts.URL)
+	admin.send(c.Mv, "8bit")
+	admin.waitText("nick set: 8bit")
+
+	for _, cmd := range sudoCommands {
+		line := cmd.Name
+		for range strings.Fields(cmd.Args) {
+			line += " x"
+		}
+		admin.send(c.Sudo, line)
+		m := admin.wait(func(m c.SMsg) bool { return m.Id == "system" })
+		if strings.HasPrefix(m.Msg, "Invalid command") {
+			t.Errorf("/sudo %v: %v", line, m.Msg)
+		}
+	}
+
+	admin.send(c.Sudo, "man")
+	m := admin.waitText("Admin commands")
+	for _, cmd := range sudoCommands {
+		if !strings.Contains(m.Msg, "\n  "+cmd.Name) {
+			t.Errorf("/sudo man does not list %v", cmd.Name)
+		}
+	}
+}
+
+// TestSudoTtl checks that room ttls are kept after a restart.
+func TestSudoTtl(t *testing.T) {
+	s, ts := testServer(t)
+	admin := dialTest(t, ts.URL)
+	admin.send(c.Mv, "8bit")
+	admin.waitText("nick set: 8bit")
+
+	for _, ttl := range []string{"500ms", "1500ms", "-1s"} {
+		admin.send(c.Sudo, "ttl general "+ttl)
+		admin.waitText("Invalid ttl, use whole seconds: " + ttl)
+	}
+	admin.send(c.Sudo, "ttl general 90s")
+	admin.waitText("Default ttl in general: 1m30s")
+
+	ttls, err := loadTtls(s.dbase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttls["general"] != 90*time.Second {
+		t.Errorf("saved ttl %v, want 1m30s", ttls["general"])
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	s, _ := testServer(t)
+	tests := []struct {
+		u    user
+		perm string
+		want bool
+	}{
+		{user{nick: "alice"}, permAny, true},
+		{user{nick: "alice"}, permAuth, false},
+		{user{nick: "alice", auth: true}, permAuth, true},
+		{user{nick: "8bit"}, permOp, false},
+		{user{nick: "8bit"}, permAdmin, false},
+		{user{nick: "8bit", auth: true}, permAdmin, true},
+		{user{nick: "alice", auth: true}, permAdmin, false},
+	}
+	for _, tt := range tests {
+		if got := s.allowed(tt.u, tt.perm); got != tt.want {
+			t.Errorf("allowed(%+v, %v) = %v, want %v", tt.u, tt.perm, got, tt.want)
+		}
+	}
+}
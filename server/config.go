@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	c "go-chat/common"
+
+	"github.com/alexflint/go-arg"
+	"github.com/alexflint/go-scalar"
+)
+
+type duration time.Duration
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+type settings struct {
+	admin  string
+	nickm  map[string]string
+	motd   string
+	rate   float64
+	burst  int
+	redact bool
+	token  string
+	maxLen int
+	// websocket options, applied to new connections
+	compress  c.Compression
+	threshold int
+	origins   []string
+	readLimit int64
+	// keepalive pings, applied to new connections
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+}
+
+func (s server) cfg() *settings {
+	return s.opts.Load()
+}
+
+// newParser returns the args with their defaults and the config file applied,
+// and a parser for the command line and environment. go-arg is told to ignore
+// defaults since it would otherwise reset zero values from the file to them.
+func newParser(argv []string) (*args, *arg.Parser, error) {
+	a := &args{}
+	if err := setDefaults(a); err != nil {
+		return nil, nil, err
+	}
+	if path := configPath(argv); path != "" {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = json.Unmarshal(file, a)
+		if err != nil {
+			return nil, nil, fmt.Errorf("config %v: %w", path, err)
+		}
+	}
+
+	p, err := arg.NewParser(arg.Config{IgnoreDefault: true}, a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return a, p, nil
+}
+
+// setDefaults sets the fields of a to the values of their default tags.
+func setDefaults(a *args) error {
+	v := reflect.ValueOf(a).Elem()
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		def, ok := field.Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+		if err := scalar.ParseValue(v.Field(i), def); err != nil {
+			return fmt.Errorf("default for %v: %w", field.Name, err)
+		}
+	}
+	return nil
+}
+
+func configPath(argv []string) string {
+	for i, v := range argv {
+		if v == "-c" || v == "--config" {
+			if i+1 < len(argv) {
+				return argv[i+1]
+			}
+		} else if path, ok := strings.CutPrefix(v, "--config="); ok {
+			return path
+		}
+	}
+	return os.Getenv("CONFIG")
+}
+
+func newSettings(a args) (*settings, error) {
+	nickMap, err := loadNickMap(a.NickMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return &settings{
+		admin:  a.Admin,
+		nickm:  nickMap,
+		motd:   a.Motd,
+		rate:   a.Rate,
+		burst:  max(int(a.Burst), 1),
+		redact: a.Redact,
+		token:  a.Token,
+		maxLen: max(int(a.MaxLen), 1),
+
+		compress:  a.Compress,
+		threshold: int(a.Threshold),
+		origins:   a.Origins,
+		readLimit: max(int64(a.ReadLimit), 1024),
+
+		pingInterval: time.Duration(a.PingInt),
+		pingTimeout:  max(time.Duration(a.PingWait), time.Second),
+	}, nil
+}
+
+func (s server) reload(old args, level *slog.LevelVar) (args, error) {
+	a, p, err := newParser(os.Args[1:])
+	if err != nil {
+		return old, err
+	}
+
+	err = p.Parse(os.Args[1:])
+	if err != nil {
+		return old, err
+	}
+
+	set, err := newSettings(*a)
+	if err != nil {
+		return old, err
+	}
+
+	s.opts.Store(set)
+	level.Set(a.LogLvl)
+
+	if a.DB != old.DB || a.HistLen != old.HistLen || a.Bind != old.Bind || a.Port != old.Port || a.Listen != old.Listen || a.LogFmt != old.LogFmt || a.IrcPort != old.IrcPort ||
+		a.Name != old.Name || a.LinkToken != old.LinkToken || !slices.Equal(a.Links, old.Links) || !slices.Equal(a.LinkRooms, old.LinkRooms) ||
+		a.HubListen != old.HubListen || a.Backplane != old.Backplane {
+		s.log.Warn("some settings require a restart to apply: db, hist_len, bind, port, listen, log_format, irc_port, server_name, link_token, links, link_rooms, backplane_listen, backplane")
+	}
+	s.log.Info("reloaded settings", "admin", set.admin, "nicks", len(set.nickm), "rate", set.rate, "burst", set.burst, "level", a.LogLvl)
+
+	return *a, nil
+}
+
+type limiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) allow(rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens = min(float64(burst), l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
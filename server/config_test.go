@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func parseArgs(t *testing.T, file string, argv ...string) args {
+	t.Helper()
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		argv = append([]string{"--config", path}, argv...)
+	}
+
+	a, p, err := newParser(argv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Parse(argv); err != nil {
+		t.Fatal(err)
+	}
+	return *a
+}
+
+func TestConfigDefaults(t *testing.T) {
+	a := parseArgs(t, "")
+	if a.Admin != "8bit" || a.Threshold != 256 || time.Duration(a.PingInt) != 30*time.Second {
+		t.Errorf("defaults not set: admin %q, threshold %v, ping interval %v", a.Admin, a.Threshold, time.Duration(a.PingInt))
+	}
+}
+
+func TestConfigFileZeroValues(t *testing.T) {
+	a := parseArgs(t, `{"ping_interval": "0s", "compression_threshold": 0, "admin": "root"}`)
+	if a.PingInt != 0 {
+		t.Errorf("ping interval %v, want 0 from the file", time.Duration(a.PingInt))
+	}
+	if a.Threshold != 0 {
+		t.Errorf("compression threshold %v, want 0 from the file", a.Threshold)
+	}
+	if a.Admin != "root" {
+		t.Errorf("admin %q, want root from the file", a.Admin)
+	}
+}
+
+func TestConfigArgsOverrideFile(t *testing.T) {
+	t.Setenv("MOTD", "from env")
+	a := parseArgs(t, `{"ping_interval": "0s", "motd": "from file"}`, "--ping-interval", "5s")
+	if time.Duration(a.PingInt) != 5*time.Second {
+		t.Errorf("ping interval %v, want 5s from the command line", time.Duration(a.PingInt))
+	}
+	if a.Motd != "from env" {
+		t.Errorf("motd %q, want it from the environment", a.Motd)
+	}
+}
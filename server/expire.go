@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	c "go-chat/common"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func loadTtls(db *sqlx.DB) (map[string]time.Duration, error) {
+	rows := []struct {
+		Name string
+		Ttl  int64
+	}{}
+	err := db.Select(&rows, "SELECT name, ttl FROM rooms WHERE ttl > 0")
+	if err != nil {
+		return nil, err
+	}
+
+	rttls := make(map[string]time.Duration)
+	for _, r := range rows {
+		rttls[r.Name] = time.Duration(r.Ttl) * time.Second
+	}
+
+	return rttls, nil
+}
+
+func (s server) loadExpiries() error {
+	for room := range s.rooms {
+		msgs := []c.SMsg{}
+		err := s.dbase.Select(&msgs, fmt.Sprintf("SELECT %s FROM %s WHERE exp IS NOT NULL", roomCols, room))
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			s.expireAfter(room, m.Num, time.Until(*m.Exp))
+		}
+	}
+
+	return nil
+}
+
+func (s server) setTtl(room string, ttl time.Duration) error {
+	_, err := s.dbase.Exec("UPDATE rooms SET ttl = $1 WHERE name = $2", int64(ttl.Seconds()), room)
+	if err != nil {
+		return err
+	}
+
+	s.conns.sm.Lock()
+	if ttl > 0 {
+		s.rttls[room] = ttl
+	} else {
+		delete(s.rttls, room)
+	}
+	s.conns.sm.Unlock()
+
+	return nil
+}
+
+// roomTtl returns the time after which messages posted in room expire, or 0
+// if they don't.
+func (s server) roomTtl(room string) time.Duration {
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	return s.rttls[room]
+}
+
+func (s server) expireAfter(room string, num int64, ttl time.Duration) {
+	time.AfterFunc(ttl, func() {
+		s.conns.sm.Lock()
+		s.rhist[room] = slices.DeleteFunc(slices.Clone(s.rhist[room]), func(m c.SMsg) bool {
+			return m.Num == num
+		})
+		s.conns.sm.Unlock()
+
+		if !s.queue(logMsg{Ch: room, Msg: c.SMsg{Num: num}, Op: logDelete}) {
+			return
+		}
+		s.broadcast(context.Background(), room, c.SMsg{Tim: time.Now(), Id: "system", Typ: c.Expire, Num: num})
+	})
+}
+
+func deleteMessage(db *sqlx.DB, room string, num int64) error {
+	_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE num = $1", room), num)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"pins", "polls", "votes"} {
+		_, err = db.Exec(fmt.Sprintf("DELETE FROM %s WHERE room = $1 AND num = $2", table), room, num)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
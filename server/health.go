@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	c "go-chat/common"
+)
+
+type state struct {
+	started time.Time
+	logging atomic.Bool
+	serving atomic.Bool
+	logged  chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+	// set when shutdown starts closing connections, new ones are refused
+	closing bool
+	wg      sync.WaitGroup
+}
+
+type check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status      string           `json:"status"`
+	Version     string           `json:"version"`
+	Uptime      string           `json:"uptime"`
+	Connections int              `json:"connections"`
+	Checks      map[string]check `json:"checks,omitempty"`
+}
+
+func (s server) health(w http.ResponseWriter, r *http.Request) {
+	s.conns.sm.Lock()
+	wc := len(s.conns.cm)
+	s.conns.sm.Unlock()
+
+	report := healthReport{
+		Status:      "ok",
+		Version:     c.Version,
+		Uptime:      time.Since(s.state.started).Round(time.Second).String(),
+		Connections: wc,
+	}
+
+	switch r.URL.Path {
+	case "/health/live":
+	case "/health", "/health/ready":
+		report.Checks = s.readiness(r.Context())
+		for _, chk := range report.Checks {
+			if chk.Status != "ok" {
+				report.Status = "unavailable"
+			}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s server) readiness(ctx context.Context) map[string]check {
+	checks := make(map[string]check)
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var n int
+	if err := s.dbase.PingContext(ctx); err != nil {
+		checks["database"] = check{Status: "failed", Error: err.Error()}
+	} else if err := s.dbase.GetContext(ctx, &n, "SELECT COUNT(*) FROM rooms"); err != nil {
+		checks["database"] = check{Status: "failed", Error: err.Error()}
+	} else {
+		checks["database"] = check{Status: "ok"}
+	}
+
+	if !s.state.logging.Load() {
+		checks["logger"] = check{Status: "failed", Error: "logger stopped"}
+	} else if backlog := len(s.logCh); backlog > cap(s.logCh)*3/4 {
+		checks["logger"] = check{Status: "failed", Error: fmt.Sprintf("backlog %v of %v", backlog, cap(s.logCh))}
+	} else {
+		checks["logger"] = check{Status: "ok"}
+	}
+
+	if s.state.serving.Load() {
+		checks["listener"] = check{Status: "ok"}
+	} else {
+		checks["listener"] = check{Status: "failed", Error: "not accepting connections"}
+	}
+
+	return checks
+}
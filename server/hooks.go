@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	c "go-chat/common"
+)
+
+const createHooksTable = "CREATE TABLE IF NOT EXISTS hooks (token TEXT PRIMARY KEY, room TEXT, name TEXT, tim DATETIME)"
+
+type hook struct {
+	Token string
+	Room  string
+	Name  string
+	Tim   time.Time
+}
+
+// nick returns the nick messages from the hook are sent as, which can't be
+// registered or taken by users.
+func (h hook) nick() string {
+	return h.Name + "[bot]"
+}
+
+// slackMsg is the subset of a Slack incoming webhook payload that is used.
+type slackMsg struct {
+	Text        string `json:"text"`
+	Attachments []struct {
+		Fallback string `json:"fallback"`
+		Text     string `json:"text"`
+	} `json:"attachments"`
+}
+
+func (m slackMsg) body() string {
+	lines := []string{}
+	if m.Text != "" {
+		lines = append(lines, m.Text)
+	}
+	for _, a := range m.Attachments {
+		if a.Text != "" {
+			lines = append(lines, a.Text)
+		} else if a.Fallback != "" {
+			lines = append(lines, a.Fallback)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s server) newHook(room string, name string) (hook, error) {
+	if !s.hasRoom(room) {
+		return hook{}, fmt.Errorf("%w: %v", errRoomMissing, room)
+	}
+	if name == "" || !alphanumeric(name) {
+		return hook{}, fmt.Errorf("invalid name: %v", name)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return hook{}, err
+	}
+
+	h := hook{Token: hex.EncodeToString(b), Room: room, Name: name, Tim: time.Now()}
+	_, err := s.dbase.NamedExec("INSERT INTO hooks (token, room, name, tim) VALUES (:token, :room, :name, :tim)", h)
+	return h, err
+}
+
+func (s server) rmHook(token string) (bool, error) {
+	res, err := s.dbase.Exec("DELETE FROM hooks WHERE token = $1", token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s server) hooksText() string {
+	hooks := []hook{}
+	err := s.dbase.Select(&hooks, "SELECT * FROM hooks ORDER BY room, name")
+	if err != nil {
+		return fmt.Sprintf("Failed: %v", err)
+	}
+	if len(hooks) == 0 {
+		return "No webhooks"
+	}
+
+	text := "Webhooks:"
+	for _, h := range hooks {
+		text += fmt.Sprintf("\n  %v as %v: /hooks/%v", h.Room, h.nick(), h.Token)
+	}
+	return text
+}
+
+func (s server) hook(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/hooks/")
+	h := hook{}
+	err := s.dbase.Get(&h, "SELECT * FROM hooks WHERE token = $1", token)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.log.Warn("hook unknown", "addr", r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.log.Error("hook", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if !s.hasRoom(h.Room) {
+		http.Error(w, "room does not exist", http.StatusGone)
+		return
+	}
+
+	msg, err := readHook(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit := s.cfg().maxLen; utf8.RuneCountInString(msg) > limit {
+		http.Error(w, fmt.Sprintf("message too long, the limit is %v characters", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	s.log.Debug("hook", "name", h.Name, "room", h.Room, "msg", s.body(msg))
+	s.conns.sm.Lock()
+	ttl := s.rttls[h.Room]
+	s.conns.sm.Unlock()
+	if _, ok := s.post(r.Context(), h.Room, c.SMsg{Tim: time.Now(), Id: h.nick(), Msg: msg}, ttl); !ok {
+		http.Error(w, "message rejected", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// readHook reads a message from a plain text body, or a Slack compatible JSON
+// payload sent as the body or as the payload field of a form.
+func readHook(w http.ResponseWriter, r *http.Request) (string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err != nil {
+		return "", err
+	}
+
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil || !form.Has("payload") {
+			break
+		}
+		body = []byte(form.Get("payload"))
+		fallthrough
+	case "application/json":
+		m := slackMsg{}
+		if err := json.Unmarshal(body, &m); err != nil {
+			return "", fmt.Errorf("invalid payload: %w", err)
+		}
+		body = []byte(m.body())
+	}
+
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		return "", errors.New("empty message")
+	}
+	return msg, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	c "go-chat/common"
+)
+
+func TestHook(t *testing.T) {
+	s, ts := testServer(t, "--max-len", "20")
+	h, err := s.newHook("general", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dialTest(t, ts.URL)
+
+	payload := url.Values{"payload": {`{"attachments": [{"fallback": "from a form"}]}`}}.Encode()
+	tests := []struct {
+		name   string
+		token  string
+		typ    string
+		body   string
+		status int
+		msg    string
+	}{
+		{"text", h.Token, "text/plain", "build passed", http.StatusOK, "build passed"},
+		{"slack", h.Token, "application/json", `{"text": "deploy done"}`, http.StatusOK, "deploy done"},
+		{"form", h.Token, "application/x-www-form-urlencoded", payload, http.StatusOK, "from a form"},
+		{"bad token", "0123", "text/plain", "let me in", http.StatusNotFound, ""},
+		{"bad json", h.Token, "application/json", "{", http.StatusBadRequest, ""},
+		{"too long", h.Token, "text/plain", strings.Repeat("a", 21), http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Post(ts.URL+"/hooks/"+tt.token, tt.typ, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.status {
+				t.Fatalf("status %v, want %v", res.StatusCode, tt.status)
+			}
+			if tt.msg == "" {
+				return
+			}
+			m := client.wait(func(m c.SMsg) bool { return m.Typ == c.Text })
+			if m.Msg != tt.msg || m.Id != "ci[bot]" {
+				t.Errorf("got %q from %q, want %q from ci[bot]", m.Msg, m.Id, tt.msg)
+			}
+		})
+	}
+}
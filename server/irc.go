@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	c "go-chat/common"
+	"go-chat/lib/client"
+)
+
+// The IRC gateway lets IRC clients join go-chat. Each IRC connection is
+// bridged to its own websocket connection to this server, so IRC users share
+// rooms, history, nick registration, bans and rate limits with everyone else.
+// A go-chat user is in one room at a time, so IRC users can only join one
+// channel, #<room>, at a time.
+
+const ircServer = "go-chat"
+
+type ircMsg struct {
+	cmd    string
+	params []string
+}
+
+// parseIRC splits a line into its command and parameters, ignoring the prefix
+// and message tags.
+func parseIRC(line string) ircMsg {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	params := strings.Fields(line)
+	if len(params) == 0 {
+		return ircMsg{}
+	}
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return ircMsg{cmd: strings.ToUpper(params[0]), params: params[1:]}
+}
+
+func (m ircMsg) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+	return ""
+}
+
+// serveIRC accepts IRC clients on ln until it is closed, bridging them to the
+// websocket server at wsAddr.
+func (s server) serveIRC(ln net.Listener, wsAddr string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.log.Info("irc gateway stopped", "err", err)
+			return
+		}
+		sess := &ircSession{s: s, conn: conn, w: bufio.NewWriter(conn), wsAddr: wsAddr}
+		go sess.run()
+	}
+}
+
+type ircSession struct {
+	s      server
+	conn   net.Conn
+	w      *bufio.Writer
+	wsAddr string
+	cl     *client.Client
+
+	nick    string // go-chat nick, empty until registered
+	pending string // nick requested with NICK
+	pass    string
+	user    bool
+	channel string // joined room, empty if none
+	joining string
+	echoes  int // own messages sent and not yet echoed back
+}
+
+func (is *ircSession) run() {
+	defer is.conn.Close()
+	// send the ERROR line when closing the link
+	defer is.w.Flush()
+	addr := is.conn.RemoteAddr().String()
+	is.s.log.Info("irc connected", "addr", addr)
+	defer is.s.log.Info("irc disconnected", "addr", addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl, err := client.Connect(ctx, is.wsAddr, client.Options{})
+	if err != nil {
+		is.s.log.Error("irc gateway connect", "addr", addr, "err", err)
+		is.send("ERROR :Closing link (server unavailable)")
+		return
+	}
+	defer cl.Close()
+	is.cl = cl
+	events := cl.Subscribe()
+
+	cfg := is.s.cfg()
+	interval, timeout := cfg.pingInterval, cfg.pingTimeout
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(is.conn)
+		scanner.Buffer(make([]byte, 4096), 8192)
+		for {
+			// a client that doesn't answer our PING is dropped
+			is.conn.SetReadDeadline(time.Now().Add(interval + timeout))
+			if !scanner.Scan() {
+				return
+			}
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			if !is.handle(parseIRC(line)) {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok || ev.Type == client.Disconnected {
+				is.send("ERROR :Closing link (disconnected from server)")
+				return
+			}
+			if ev.Type == client.Message {
+				is.receive(ev.Msg)
+			}
+		case <-ticker.C:
+			is.send("PING :" + ircServer)
+		}
+		is.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if is.w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// send queues a line for the client, it is flushed after each command or
+// event is handled.
+func (is *ircSession) send(format string, args ...any) {
+	fmt.Fprintf(is.w, format+"\r\n", args...)
+}
+
+func (is *ircSession) reply(num string, params string) {
+	target := is.nick
+	if target == "" {
+		target = "*"
+	}
+	is.send(":%v %v %v %v", ircServer, num, target, params)
+}
+
+func (is *ircSession) command(typ c.CMsgT, msg string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := is.cl.Command(ctx, typ, msg); err != nil {
+		is.s.log.Warn("irc gateway send", "nick", is.nick, "err", err)
+	}
+}
+
+// handle runs a command from the client, it returns false to disconnect.
+func (is *ircSession) handle(m ircMsg) bool {
+	switch m.cmd {
+	case "":
+		return true
+	case "CAP":
+		if sub := strings.ToUpper(m.param(0)); sub == "LS" || sub == "LIST" {
+			is.send(":%v CAP * %v :", ircServer, sub)
+		} else if sub == "REQ" {
+			is.send(":%v CAP * NAK :%v", ircServer, m.param(1))
+		}
+		return true
+	case "PASS":
+		is.pass = m.param(0)
+		return true
+	case "NICK":
+		if m.param(0) == "" {
+			is.reply("431", ":No nickname given")
+			return true
+		}
+		is.pending = m.param(0)
+		if is.user || is.nick != "" {
+			is.login()
+		}
+		return true
+	case "USER":
+		if is.nick != "" {
+			is.reply("462", ":You may not reregister")
+			return true
+		}
+		is.user = true
+		if is.pending != "" {
+			is.login()
+		}
+		return true
+	case "PING":
+		is.send(":%v PONG %v :%v", ircServer, ircServer, m.param(0))
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		is.send("ERROR :Closing link (quit)")
+		return false
+	}
+
+	if is.nick == "" {
+		is.reply("451", ":You have not registered")
+		return true
+	}
+
+	switch m.cmd {
+	case "JOIN":
+		is.join(m)
+	case "PART":
+		for _, ch := range strings.Split(m.param(0), ",") {
+			is.part(ch)
+		}
+	case "PRIVMSG", "NOTICE":
+		is.privmsg(m)
+	case "NAMES":
+		is.names(m.param(0))
+	case "LIST":
+		is.list()
+	case "TOPIC":
+		if !is.inChannel(m.param(0)) {
+			is.reply("442", m.param(0)+" :You're not on that channel")
+		} else if len(m.params) > 1 {
+			is.reply("482", m.param(0)+" :Topics are not supported")
+		} else {
+			is.reply("331", m.param(0)+" :No topic is set")
+		}
+	case "WHO":
+		if is.inChannel(m.param(0)) {
+			for _, nick := range is.s.roomUsers(is.channel) {
+				nick = ircNick(nick)
+				is.reply("352", fmt.Sprintf("#%v %v %v %v %v H :0 %v", is.channel, nick, ircServer, ircServer, nick, nick))
+			}
+		}
+		is.reply("315", m.param(0)+" :End of WHO list")
+	case "MODE":
+		if strings.HasPrefix(m.param(0), "#") {
+			is.reply("324", m.param(0)+" +")
+		} else {
+			is.reply("221", "+")
+		}
+	default:
+		// plugin commands can be used directly, e.g. /shrug
+		name := strings.ToLower(m.cmd)
+		if findCommand(name) != nil {
+			is.command(c.Cmd, strings.TrimSpace(name+" "+strings.Join(m.params, " ")))
+		} else {
+			is.reply("421", m.cmd+" :Unknown command")
+		}
+	}
+	return true
+}
+
+func (is *ircSession) login() {
+	login := is.pending
+	if is.pass != "" {
+		login += ":" + is.pass
+	}
+	is.command(c.Mv, login)
+}
+
+func (is *ircSession) welcome() {
+	is.reply("001", fmt.Sprintf(":Welcome to go-chat, %v", is.nick))
+	is.reply("002", fmt.Sprintf(":Your host is %v, running version %v", ircServer, c.Version))
+	is.reply("003", ":This server was created "+is.s.state.started.Format(time.RFC1123))
+	is.reply("004", fmt.Sprintf("%v %v o o", ircServer, c.Version))
+	is.reply("005", "CHANTYPES=# CHANLIMIT=#:1 :are supported by this server")
+	if motd := is.s.cfg().motd; motd != "" {
+		is.reply("375", ":- "+ircServer+" Message of the day -")
+		for _, line := range strings.Split(motd, "\n") {
+			is.reply("372", ":- "+line)
+		}
+		is.reply("376", ":End of /MOTD command")
+	} else {
+		is.reply("422", ":MOTD File is missing")
+	}
+}
+
+func (is *ircSession) inChannel(name string) bool {
+	return is.channel != "" && name == "#"+is.channel
+}
+
+func (is *ircSession) join(m ircMsg) {
+	if m.param(0) == "0" {
+		is.part("#" + is.channel)
+		return
+	}
+
+	channels := strings.Split(m.param(0), ",")
+	for _, ch := range channels[1:] {
+		is.reply("405", ch+" :You can only join one channel at a time")
+	}
+	room, ok := strings.CutPrefix(channels[0], "#")
+	if !ok || room == "" {
+		is.reply("403", channels[0]+" :No such channel")
+		return
+	}
+	is.joining = room
+	is.command(c.Cd, room)
+}
+
+func (is *ircSession) part(ch string) {
+	if !is.inChannel(ch) {
+		is.reply("442", ch+" :You're not on that channel")
+		return
+	}
+	is.send(":%v PART %v", is.prefix(is.nick), ch)
+	is.channel = ""
+}
+
+func (is *ircSession) privmsg(m ircMsg) {
+	target, text := m.param(0), m.param(1)
+	if text == "" {
+		if m.cmd == "PRIVMSG" {
+			is.reply("412", ":No text to send")
+		}
+		return
+	}
+	if !is.inChannel(target) {
+		if m.cmd == "NOTICE" {
+			return
+		}
+		if strings.HasPrefix(target, "#") {
+			is.reply("404", target+" :Cannot send to channel, join it first")
+		} else {
+			is.reply("401", target+" :Private messages are not supported")
+		}
+		return
+	}
+
+	typ := c.Echo
+	if m.cmd == "NOTICE" {
+		typ = c.Notice
+	} else if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+		typ, text = c.Me, strings.TrimSuffix(action, "\x01")
+	} else if strings.HasPrefix(text, "\x01") {
+		// other CTCP requests are ignored
+		return
+	}
+	is.echoes++
+	is.command(typ, text)
+}
+
+func (is *ircSession) names(ch string) {
+	if ch == "" {
+		ch = "#" + is.channel
+	}
+	if is.inChannel(ch) {
+		nicks := []string{}
+		for _, nick := range is.s.roomUsers(is.channel) {
+			nicks = append(nicks, ircNick(nick))
+		}
+		is.reply("353", fmt.Sprintf("= %v :%v", ch, strings.Join(nicks, " ")))
+	}
+	is.reply("366", ch+" :End of /NAMES list")
+}
+
+func (is *ircSession) list() {
+	is.reply("321", "Channel :Users  Name")
+	for _, room := range is.s.roomNames() {
+		is.reply("322", fmt.Sprintf("#%v %v :", room, len(is.s.roomUsers(room))))
+	}
+	is.reply("323", ":End of /LIST")
+}
+
+func (is *ircSession) prefix(nick string) string {
+	return fmt.Sprintf("%v!%v@%v", nick, nick, ircServer)
+}
+
+// ircUnsafe are removed from text sent to the client, since they would end or
+// truncate the line and let a message inject IRC commands.
+var ircUnsafe = strings.NewReplacer("\r", "", "\x00", "")
+
+// ircLines splits text into lines that are safe to send to the client.
+func ircLines(text string) []string {
+	return strings.Split(ircUnsafe.Replace(text), "\n")
+}
+
+// ircNick returns nick without characters that can't be in an IRC prefix or
+// parameter.
+func ircNick(nick string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == 0 || r == ' ' {
+			return -1
+		}
+		return r
+	}, nick)
+}
+
+// receive translates a message from the server for the client.
+func (is *ircSession) receive(smsg c.SMsg) {
+	switch {
+	case smsg.Typ == c.Nick:
+		is.nickResult(smsg.Msg, smsg.Num)
+		return
+	case smsg.Typ == c.Room:
+		is.roomResult(smsg.Msg, smsg.Num)
+		return
+	case smsg.Id == "system" && smsg.Typ == c.Text:
+		is.notice(smsg.Msg)
+		return
+	}
+	if is.nick == "" || is.channel == "" {
+		return
+	}
+
+	ch := "#" + is.channel
+	from := is.prefix(ircNick(smsg.Id))
+	switch smsg.Typ {
+	case c.Text, c.Action, c.Note:
+		// the server echoes our own messages back
+		if smsg.Id == is.nick && is.echoes > 0 {
+			is.echoes--
+			return
+		}
+		for _, line := range ircLines(smsg.Msg) {
+			switch smsg.Typ {
+			case c.Action:
+				is.send(":%v PRIVMSG %v :\x01ACTION %v\x01", from, ch, line)
+			case c.Note:
+				is.send(":%v NOTICE %v :%v", from, ch, line)
+			default:
+				is.send(":%v PRIVMSG %v :%v", from, ch, line)
+			}
+		}
+	case c.Announce, c.Poll:
+		for _, line := range ircLines(smsg.Msg) {
+			is.send(":%v NOTICE %v :%v", ircServer, ch, line)
+		}
+	}
+}
+
+// nickResult completes a NICK, or registration if the client has no nick yet.
+func (is *ircSession) nickResult(nick string, result int64) {
+	switch result {
+	case c.Done:
+		if is.nick == "" {
+			is.nick = nick
+			is.welcome()
+		} else if nick != is.nick {
+			is.send(":%v NICK :%v", is.prefix(is.nick), nick)
+			is.nick = nick
+		}
+	case c.NickUsed:
+		is.reply("433", ircNick(is.pending)+" :Nickname is already in use")
+	case c.NickInvalid:
+		is.reply("432", ircNick(is.pending)+" :Erroneous nickname or wrong password")
+	case c.NickBanned:
+		is.reply("465", ":You are banned from this server")
+	}
+}
+
+// roomResult completes a JOIN, or moves the client to the room it was put in
+// by the server.
+func (is *ircSession) roomResult(room string, result int64) {
+	if result == c.RoomInvalid {
+		if is.joining != "" {
+			is.reply("403", "#"+is.joining+" :No such channel")
+			is.joining = ""
+		}
+		return
+	}
+
+	joined := is.joining == room
+	is.joining = ""
+	if is.channel == room || is.channel == "" && !joined {
+		// rejoining the current room, or the server moving a client that
+		// left its channel
+		return
+	}
+	if is.channel != "" {
+		is.send(":%v PART #%v", is.prefix(is.nick), is.channel)
+	}
+	is.channel = room
+	is.send(":%v JOIN #%v", is.prefix(is.nick), is.channel)
+	is.reply("331", "#"+is.channel+" :No topic is set")
+	is.names("")
+}
+
+// notice passes a reply from the server on to a registered client.
+func (is *ircSession) notice(msg string) {
+	if is.nick == "" {
+		return
+	}
+	for _, line := range ircLines(msg) {
+		is.send(":%v NOTICE %v :%v", ircServer, is.nick, line)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+)
+
+type ircClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialIRC starts the IRC gateway for the server at ts and connects to it.
+func dialIRC(t *testing.T, s server, wsAddr string) *ircClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serveIRC(ln, wsAddr)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &ircClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (ic *ircClient) send(format string, args ...any) {
+	ic.t.Helper()
+	if _, err := fmt.Fprintf(ic.conn, format+"\r\n", args...); err != nil {
+		ic.t.Fatal(err)
+	}
+}
+
+// expect returns the first line containing text, skipping the others.
+func (ic *ircClient) expect(text string) string {
+	ic.t.Helper()
+	ic.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := ic.r.ReadString('\n')
+		if err != nil {
+			ic.t.Fatalf("waiting for %q: %v", text, err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if strings.Contains(line, text) {
+			return line
+		}
+	}
+}
+
+func TestIRC(t *testing.T) {
+	s, ts := testServer(t)
+	irc := dialIRC(t, s, ts.Listener.Addr().String())
+	bob := dialTest(t, ts.URL)
+	bob.send(c.Mv, "bob")
+	bob.waitText("nick set: bob")
+
+	irc.send("NICK alice")
+	irc.send("USER alice 0 * :Alice")
+	irc.expect(" 001 alice ")
+
+	irc.send("JOIN #general")
+	irc.expect(":alice!alice@go-chat JOIN #general")
+	if names := irc.expect(" 353 "); !strings.Contains(names, "alice") || !strings.Contains(names, "bob") {
+		t.Errorf("names reply %q, want alice and bob", names)
+	}
+
+	irc.send("PRIVMSG #general :hi bob")
+	if m := bob.waitText("hi bob"); m.Id != "alice" {
+		t.Errorf("message from %v, want alice", m.Id)
+	}
+
+	// a carriage return or NUL must not end the line early
+	bob.send(c.Echo, "hi\rQUIT\x00 alice\nsecond line")
+	if line := irc.expect(":bob!bob@go-chat PRIVMSG"); line != ":bob!bob@go-chat PRIVMSG #general :hiQUIT alice" {
+		t.Errorf("relayed as %q", line)
+	}
+	irc.expect(":bob!bob@go-chat PRIVMSG #general :second line")
+
+	irc.send("NICK bob")
+	irc.expect(" 433 alice bob ")
+	irc.send("NICK alice2")
+	irc.expect(":alice!alice@go-chat NICK :alice2")
+
+	irc.send("JOIN #nowhere")
+	irc.expect(" 403 alice2 #nowhere ")
+
+	irc.send("PART #general")
+	irc.expect(":alice2!alice2@go-chat PART #general")
+	irc.send("PRIVMSG #general :gone")
+	irc.expect(" 404 alice2 #general ")
+
+	irc.send("QUIT")
+	irc.expect("ERROR :Closing link (quit)")
+	if _, err := irc.r.ReadString('\n'); err == nil {
+		t.Error("connection still open after QUIT")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	ws "github.com/coder/websocket"
+)
+
+// keepalive pings conn every interval and closes it if no pong arrives within
+// timeout, so half-open connections are removed instead of lingering in /who.
+// The round trip time is stored on the user. It returns when ctx is done.
+func (s server) keepalive(ctx context.Context, conn *ws.Conn, interval time.Duration, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		err := conn.Ping(pctx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.conns.sm.Lock()
+			u := s.conns.cm[conn]
+			s.conns.sm.Unlock()
+			s.log.Info("ping timeout, closing connection", "addr", u.addr, "nick", u.nick, "err", err)
+			s.stats.reap()
+			conn.CloseNow()
+			return
+		}
+
+		rtt := time.Since(start)
+		s.conns.sm.Lock()
+		if u, ok := s.conns.cm[conn]; ok {
+			u.rtt = rtt
+			s.conns.cm[conn] = u
+		}
+		s.conns.sm.Unlock()
+	}
+}
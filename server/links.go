@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+	"github.com/jmoiron/sqlx"
+)
+
+// links stores the last message number received from each linked server in
+// each room, so gaps can be filled after a link drops.
+const createLinksTable = "CREATE TABLE IF NOT EXISTS links (server TEXT, room TEXT, num INTEGER, PRIMARY KEY (server, room))"
+
+const (
+	linkProtocol  = "gochat.link.v1"
+	linkQueue     = 256
+	linkPresence  = time.Second
+	linkReadLimit = 1 << 20
+)
+
+// linkMsg is sent as JSON between linked servers. A link starts with both
+// sides sending a hello with their shared rooms and current message numbers,
+// then a sync with the last number they have seen from the other side in each
+// room. Messages after those are replayed before live messages are relayed.
+// Messages that expire are sent with the time they have left in TTL, as the
+// clocks of the servers may differ.
+type linkMsg struct {
+	Typ    string           `json:"typ"`
+	Server string           `json:"server,omitempty"`
+	Rooms  []string         `json:"rooms,omitempty"`
+	Nums   map[string]int64 `json:"nums,omitempty"`
+	Room   string           `json:"room,omitempty"`
+	Msg    *c.SMsg          `json:"msg,omitempty"`
+	TTL    time.Duration    `json:"ttl,omitempty"`
+	Users  []string         `json:"users,omitempty"`
+}
+
+// peer is a linked server.
+type peer struct {
+	name  string
+	addr  string
+	conn  *ws.Conn
+	rooms []string
+	out   chan linkMsg
+	// users in each shared room on the peer, guarded by links.mu
+	users map[string][]string
+}
+
+type links struct {
+	name  string
+	token string
+	rooms []string
+	db    *sqlx.DB
+	log   *slog.Logger
+	mu    sync.Mutex
+	peers map[*peer]struct{}
+	last  map[string]map[string]int64
+}
+
+func newLinks(name string, token string, rooms []string, db *sqlx.DB, log *slog.Logger) *links {
+	return &links{
+		name:  name,
+		token: token,
+		rooms: rooms,
+		db:    db,
+		log:   log,
+		peers: make(map[*peer]struct{}),
+		last:  make(map[string]map[string]int64),
+	}
+}
+
+func validServer(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, func(r rune) bool {
+		return !alphanumeric(string(r)) && r != '.' && r != '-'
+	})
+}
+
+// relayable reports whether smsg was posted by a local user and can be sent
+// to linked servers. Messages from other servers are never relayed again,
+// which keeps them from looping between servers.
+func relayable(smsg c.SMsg) bool {
+	if smsg.Id == "system" || strings.Contains(smsg.Id, "@") {
+		return false
+	}
+	return smsg.Typ == c.Text || smsg.Typ == c.Action || smsg.Typ == c.Note
+}
+
+// msgLink returns the link message relaying smsg in room, or false if smsg has
+// already expired.
+func msgLink(room string, smsg c.SMsg) (linkMsg, bool) {
+	lmsg := linkMsg{Typ: "msg", Room: room, Msg: &smsg}
+	if smsg.Exp != nil {
+		lmsg.TTL = time.Until(*smsg.Exp)
+	}
+	return lmsg, smsg.Exp == nil || lmsg.TTL > 0
+}
+
+func (l *links) add(p *peer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peers[p] = struct{}{}
+}
+
+func (l *links) remove(p *peer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.peers, p)
+}
+
+// relay queues smsg for the peers sharing room. A peer that falls behind is
+// disconnected, it catches up from history when the link is restored.
+func (l *links) relay(room string, smsg c.SMsg) {
+	lmsg, ok := msgLink(room, smsg)
+	if !ok || !relayable(smsg) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for p := range l.peers {
+		if !slices.Contains(p.rooms, room) {
+			continue
+		}
+		select {
+		case p.out <- lmsg:
+		default:
+			l.log.Warn("link queue full, closing link", "server", p.name, "addr", p.addr)
+			delete(l.peers, p)
+			go p.conn.Close(ws.StatusTryAgainLater, "queue full")
+		}
+	}
+}
+
+// users returns the namespaced nicks of the remote users in room.
+func (l *links) users(room string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	users := []string{}
+	for p := range l.peers {
+		for _, nick := range p.users[room] {
+			if remote := nick + "@" + p.name; !slices.Contains(users, remote) {
+				users = append(users, remote)
+			}
+		}
+	}
+	return users
+}
+
+func (l *links) setUsers(p *peer, room string, users []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p.users[room] = users
+}
+
+func (l *links) closeAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for p := range l.peers {
+		go p.conn.Close(ws.StatusGoingAway, "server shutting down")
+	}
+}
+
+// lastSeen returns the last message number received from server in room, or
+// -1 if the room has never been linked to it.
+func (l *links) lastSeen(server string, room string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if num, ok := l.last[server][room]; ok {
+		return num
+	}
+
+	var num int64
+	err := l.db.Get(&num, "SELECT num FROM links WHERE server = $1 AND room = $2", server, room)
+	if err != nil {
+		return -1
+	}
+	l.setLast(server, room, num)
+	return num
+}
+
+// seen records num as received from server in room. It returns false if it
+// was already received, e.g. replayed after a reconnect or over a second link.
+func (l *links) seen(server string, room string, num int64) bool {
+	l.mu.Lock()
+	if num <= l.last[server][room] {
+		l.mu.Unlock()
+		return false
+	}
+	l.setLast(server, room, num)
+	l.mu.Unlock()
+	l.save(server, room, num)
+	return true
+}
+
+// record sets num as the last message number received from server in room.
+func (l *links) record(server string, room string, num int64) {
+	l.mu.Lock()
+	l.setLast(server, room, num)
+	l.mu.Unlock()
+	l.save(server, room, num)
+}
+
+func (l *links) setLast(server string, room string, num int64) {
+	if l.last[server] == nil {
+		l.last[server] = make(map[string]int64)
+	}
+	l.last[server][room] = num
+}
+
+func (l *links) save(server string, room string, num int64) {
+	_, err := l.db.Exec("INSERT INTO links (server, room, num) VALUES ($1, $2, $3) ON CONFLICT (server, room) DO UPDATE SET num = MAX(num, excluded.num)", server, room, num)
+	if err != nil {
+		l.log.Error("failed to save link state", "server", server, "room", room, "err", err)
+	}
+}
+
+type apiLink struct {
+	Server string              `json:"server"`
+	Addr   string              `json:"addr"`
+	Rooms  []string            `json:"rooms"`
+	Users  map[string][]string `json:"users"`
+}
+
+func (l *links) all() []apiLink {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := []apiLink{}
+	for p := range l.peers {
+		list = append(list, apiLink{Server: p.name, Addr: p.addr, Rooms: p.rooms, Users: maps.Clone(p.users)})
+	}
+	slices.SortFunc(list, func(a, b apiLink) int { return strings.Compare(a.Server, b.Server) })
+	return list
+}
+
+// acceptLink upgrades a request from a linked server, authenticated with the
+// link token as a bearer token.
+func (s server) acceptLink(w http.ResponseWriter, r *http.Request) {
+	if s.links.token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(s.links.token)) != 1 {
+		s.log.Warn("link unauthorized", "addr", r.RemoteAddr)
+		apiError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	conn, err := ws.Accept(w, r, &ws.AcceptOptions{Subprotocols: []string{linkProtocol}})
+	if err != nil {
+		s.log.Warn("link accept failed", "addr", r.RemoteAddr, "err", err)
+		return
+	}
+	defer conn.CloseNow()
+	if conn.Subprotocol() != linkProtocol {
+		conn.Close(ws.StatusPolicyViolation, "unsupported protocol")
+		return
+	}
+	upgraded(r)
+
+	err = s.runLink(r.Context(), conn, r.RemoteAddr)
+	s.log.Info("link closed", "addr", r.RemoteAddr, "err", err)
+}
+
+// dialLinks connects to each of the servers in urls and reconnects when a
+// link drops, until ctx is done.
+func (s server) dialLinks(ctx context.Context, urls []string) {
+	for _, url := range urls {
+		if !strings.Contains(url, "://") {
+			url = "ws://" + url
+		}
+		go s.dialLink(ctx, strings.TrimSuffix(url, "/")+"/link")
+	}
+}
+
+func (s server) dialLink(ctx context.Context, url string) {
+	backoff := time.Second
+	for {
+		conn, _, err := ws.Dial(ctx, url, &ws.DialOptions{
+			HTTPHeader:   http.Header{"Authorization": {"Bearer " + s.links.token}},
+			Subprotocols: []string{linkProtocol},
+		})
+		if err == nil {
+			backoff = time.Second
+			err = s.runLink(ctx, conn, url)
+			conn.CloseNow()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.Warn("link failed, reconnecting", "url", url, "in", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// runLink exchanges messages with a linked server until the connection
+// closes.
+func (s server) runLink(ctx context.Context, conn *ws.Conn, addr string) error {
+	conn.SetReadLimit(linkReadLimit)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rooms := []string{}
+	nums := make(map[string]int64)
+	s.conns.sm.Lock()
+	for _, room := range s.links.rooms {
+		if _, ok := s.rooms[room]; ok {
+			rooms = append(rooms, room)
+			nums[room] = s.rnums[room]
+		}
+	}
+	s.conns.sm.Unlock()
+
+	err := c.WriteMsg(ctx, conn, c.JSON, linkMsg{Typ: "hello", Server: s.links.name, Rooms: rooms, Nums: nums})
+	if err != nil {
+		return err
+	}
+	hello := linkMsg{}
+	hctx, hcancel := context.WithTimeout(ctx, 10*time.Second)
+	err = c.ReadMsg(hctx, conn, c.JSON, &hello)
+	hcancel()
+	if err != nil {
+		return err
+	}
+	if hello.Typ != "hello" || !validServer(hello.Server) || hello.Server == s.links.name {
+		conn.Close(ws.StatusPolicyViolation, "invalid hello")
+		return fmt.Errorf("invalid hello from %q", hello.Server)
+	}
+
+	p := &peer{name: hello.Server, addr: addr, conn: conn, out: make(chan linkMsg, linkQueue), users: make(map[string][]string)}
+	last := make(map[string]int64)
+	for _, room := range rooms {
+		if !slices.Contains(hello.Rooms, room) {
+			continue
+		}
+		p.rooms = append(p.rooms, room)
+		// start from the peer's current messages the first time a room is linked
+		last[room] = s.links.lastSeen(p.name, room)
+		if last[room] < 0 {
+			last[room] = hello.Nums[room]
+			s.links.record(p.name, room, last[room])
+		}
+	}
+
+	// queue live messages before replaying history so none are missed, the
+	// peer drops any it receives twice
+	s.links.add(p)
+	defer s.links.remove(p)
+	s.log.Info("linked", "server", p.name, "addr", addr, "rooms", p.rooms)
+
+	err = c.WriteMsg(ctx, conn, c.JSON, linkMsg{Typ: "sync", Nums: last})
+	if err != nil {
+		return err
+	}
+
+	go s.keepalive(ctx, conn, s.cfg().pingInterval, s.cfg().pingTimeout)
+	synced := make(chan map[string]int64, 1)
+	go s.writeLink(ctx, p, synced)
+
+	for {
+		lmsg := linkMsg{}
+		err := c.ReadMsg(ctx, conn, c.JSON, &lmsg)
+		if err != nil {
+			return err
+		}
+
+		switch lmsg.Typ {
+		case "sync":
+			select {
+			case synced <- lmsg.Nums:
+			default:
+			}
+		case "msg":
+			if lmsg.Msg == nil || !slices.Contains(p.rooms, lmsg.Room) || !relayable(*lmsg.Msg) || !s.hasRoom(lmsg.Room) {
+				continue
+			}
+			if !s.links.seen(p.name, lmsg.Room, lmsg.Msg.Num) {
+				continue
+			}
+			// messages expire with the room like local ones, or earlier if
+			// they expire sooner on the peer
+			ttl := s.roomTtl(lmsg.Room)
+			if lmsg.TTL > 0 && (ttl == 0 || lmsg.TTL < ttl) {
+				ttl = lmsg.TTL
+			}
+			smsg := c.SMsg{Tim: lmsg.Msg.Tim, Id: lmsg.Msg.Id + "@" + p.name, Msg: lmsg.Msg.Msg, Typ: lmsg.Msg.Typ}
+			s.post(ctx, lmsg.Room, smsg, ttl)
+		case "presence":
+			if slices.Contains(p.rooms, lmsg.Room) {
+				s.links.setUsers(p, lmsg.Room, lmsg.Users)
+			}
+		}
+	}
+}
+
+// writeLink waits for the peer's sync, replays the messages it missed and
+// then sends live messages and changes to the users in shared rooms.
+func (s server) writeLink(ctx context.Context, p *peer, synced <-chan map[string]int64) {
+	var last map[string]int64
+	select {
+	case <-ctx.Done():
+		return
+	case last = <-synced:
+	}
+
+	send := func(lmsg linkMsg) bool {
+		err := c.WriteMsg(ctx, p.conn, c.JSON, lmsg)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			s.log.Warn("link write failed", "server", p.name, "err", err)
+		}
+		return err == nil
+	}
+
+	for _, room := range p.rooms {
+		replayed := 0
+		for smsg := range s.missed(room, last[room]) {
+			lmsg, ok := msgLink(room, smsg)
+			if !ok || !relayable(smsg) {
+				continue
+			}
+			if !send(lmsg) {
+				return
+			}
+			replayed++
+		}
+		if replayed > 0 {
+			s.log.Info("replayed messages to link", "server", p.name, "room", room, "count", replayed)
+		}
+	}
+
+	sent := make(map[string]string)
+	presence := func() bool {
+		for _, room := range p.rooms {
+			users := s.localUsers(room)
+			key := strings.Join(users, " ")
+			if prev, ok := sent[room]; ok && prev == key {
+				continue
+			}
+			if !send(linkMsg{Typ: "presence", Room: room, Users: users}) {
+				return false
+			}
+			sent[room] = key
+		}
+		return true
+	}
+	if !presence() {
+		return
+	}
+
+	ticker := time.NewTicker(linkPresence)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case lmsg := <-p.out:
+			if !send(lmsg) {
+				return
+			}
+		case <-ticker.C:
+			if !presence() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+)
+
+// linkServer starts a server named name sharing general with linked servers.
+func linkServer(t *testing.T, name string) (server, string) {
+	t.Helper()
+	s, ts := testServer(t, "--server-name", name, "--link-token", "secret", "--link-rooms", "general")
+	return s, ts.URL
+}
+
+// waitLinks waits until s has n links.
+func waitLinks(t *testing.T, s server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.links.all()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v links, want %v", len(s.links.all()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// link links s to the servers at urls until the returned function is called.
+func link(t *testing.T, s server, urls ...string) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+	s.dialLinks(ctx, urls)
+	waitLinks(t, s, len(urls))
+	return func() {
+		cancel()
+		s.links.closeAll()
+		waitLinks(t, s, 0)
+	}
+}
+
+// received waits for a message with the text last and returns how many times
+// each message was received until then.
+func received(tc *testClient, last string) map[string]int {
+	tc.t.Helper()
+	counts := make(map[string]int)
+	tc.wait(func(m c.SMsg) bool {
+		if m.Typ == c.Text {
+			counts[m.Msg]++
+		}
+		return m.Msg == last
+	})
+	return counts
+}
+
+func TestLinks(t *testing.T) {
+	a, aURL := linkServer(t, "a")
+	b, bURL := linkServer(t, "b")
+	alice := dialTest(t, aURL)
+	bob := dialTest(t, bURL)
+	say := func(s server, nick string, msg string) {
+		s.post(t.Context(), "general", c.SMsg{Tim: time.Now(), Id: nick, Msg: msg}, 0)
+	}
+
+	// messages relay both ways in a shared room
+	unlink := link(t, a, bURL)
+	waitLinks(t, b, 1)
+	say(a, "alice", "hello from a")
+	if m := bob.waitText("hello from a"); m.Id != "alice@a" {
+		t.Errorf("message from %v, want alice@a", m.Id)
+	}
+	say(b, "bob", "hello from b")
+	if m := alice.waitText("hello from b"); m.Id != "bob@b" {
+		t.Errorf("message from %v, want bob@b", m.Id)
+	}
+	unlink()
+	waitLinks(t, b, 0)
+
+	// messages sent while the link was down are replayed once it is back
+	say(a, "alice", "missed 1")
+	say(a, "alice", "missed 2")
+	say(b, "bob", "missed 3")
+	unlink = link(t, a, bURL)
+	waitLinks(t, b, 1)
+	say(a, "alice", "live from a")
+	say(b, "bob", "live from b")
+	if counts := received(bob, "live from a"); counts["missed 1"] != 1 || counts["missed 2"] != 1 || counts["hello from a"] != 0 {
+		t.Errorf("b received %v, want each missed message once", counts)
+	}
+	if counts := received(alice, "live from b"); counts["missed 3"] != 1 || counts["hello from b"] != 0 {
+		t.Errorf("a received %v, want each missed message once", counts)
+	}
+	unlink()
+	waitLinks(t, b, 0)
+
+	// a message received over two links is posted once
+	link(t, a, bURL, bURL)
+	waitLinks(t, b, 2)
+	say(a, "alice", "twice")
+	say(a, "alice", "done")
+	if counts := received(bob, "done"); counts["twice"] != 1 {
+		t.Errorf("b received %v, want the message once", counts)
+	}
+	// the second copy of done may still be on its way
+	say(a, "alice", "end")
+	if counts := received(bob, "end"); counts["done"] != 0 || counts["twice"] != 0 {
+		t.Errorf("b received %v after the first copies", counts)
+	}
+
+	// expiring messages are relayed with the time they have left, and
+	// messages from a peer expire with the room's ttl
+	expires := func(tc *testClient, text string, ttl time.Duration) {
+		t.Helper()
+		m := tc.waitText(text)
+		if m.Exp == nil || m.Exp.Sub(m.Tim) > ttl+time.Second {
+			t.Fatalf("%q expires at %v, want within %v", text, m.Exp, ttl)
+		}
+		tc.wait(func(e c.SMsg) bool { return e.Typ == c.Expire && e.Num == m.Num })
+	}
+	a.post(t.Context(), "general", c.SMsg{Tim: time.Now(), Id: "alice", Msg: "secret"}, 200*time.Millisecond)
+	expires(bob, "secret", 200*time.Millisecond)
+	if err := b.setTtl("general", 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	say(a, "alice", "short lived")
+	expires(bob, "short lived", 200*time.Millisecond)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFdsStart = 3
+
+// listenAddr returns the network and address to listen on. Without --listen it
+// is localhost, or every IPv4 interface with --bind, on --port.
+func listenAddr(a args) (string, string) {
+	if a.Listen == "" {
+		host := "localhost"
+		if a.Bind {
+			host = "0.0.0.0"
+		}
+		return "tcp4", net.JoinHostPort(host, fmt.Sprint(a.Port))
+	}
+	if path, ok := strings.CutPrefix(a.Listen, "unix:"); ok {
+		return "unix", strings.TrimPrefix(path, "//")
+	}
+	return "tcp", a.Listen
+}
+
+// listen opens the listeners for the server and the IRC gateway, which is nil
+// if it's disabled. Listeners passed by systemd socket activation are used if
+// there are any, the first one named irc in the socket unit for the gateway
+// and every other one for the server, e.g. for IPv6 and IPv4.
+func listen(a args, log *slog.Logger) ([]net.Listener, net.Listener, error) {
+	activated, err := systemdListeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(activated) > 0 {
+		var listeners []net.Listener
+		var ircListener net.Listener
+		for _, l := range activated {
+			switch {
+			case l.name != "irc":
+				listeners = append(listeners, l)
+			case ircListener == nil:
+				ircListener = l
+			default:
+				log.Warn("closing extra irc socket passed by systemd", "addr", l.Addr())
+				l.Close()
+			}
+		}
+		if len(listeners) == 0 {
+			if ircListener != nil {
+				ircListener.Close()
+			}
+			return nil, nil, errors.New("no socket passed by systemd for the server, only irc")
+		}
+		if ircListener == nil && a.IrcPort != 0 {
+			log.Warn("irc gateway disabled, --irc-port is set but no irc socket was passed by systemd")
+		}
+		return listeners, ircListener, nil
+	}
+
+	network, addr := listenAddr(a)
+	if network == "unix" {
+		// remove the socket left behind if the server was killed, unless
+		// another server still accepts connections on it
+		if info, err := os.Stat(addr); err == nil && info.Mode().Type() == fs.ModeSocket {
+			conn, err := net.Dial("unix", addr)
+			if err == nil {
+				conn.Close()
+				return nil, nil, fmt.Errorf("%v is in use by another server", addr)
+			}
+			os.Remove(addr)
+		}
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.IrcPort == 0 {
+		return []net.Listener{listener}, nil, nil
+	}
+
+	// the gateway listens on the same host, or localhost for unix sockets
+	host, ircNetwork := "localhost", "tcp4"
+	if network != "unix" {
+		host, _, _ = net.SplitHostPort(addr)
+		ircNetwork = network
+	}
+	ircListener, err := net.Listen(ircNetwork, net.JoinHostPort(host, fmt.Sprint(a.IrcPort)))
+	if err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+	return []net.Listener{listener}, ircListener, nil
+}
+
+// activatedListener is a listener passed by systemd, named by
+// FileDescriptorName= in the socket unit or after the unit by default, so
+// names are not unique.
+type activatedListener struct {
+	net.Listener
+	name string
+}
+
+// systemdListeners returns the listeners passed by systemd socket activation
+// in the order of their file descriptors, if the server was started by a
+// socket unit.
+func systemdListeners() ([]activatedListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+
+	listeners := []activatedListener{}
+	for i := range n {
+		name := fmt.Sprint(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %v: %w", name, err)
+		}
+		listeners = append(listeners, activatedListener{l, name})
+	}
+	return listeners, nil
+}
+
+// listenURL returns the URL of the server on l, for logs.
+func listenURL(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return "unix://" + l.Addr().String()
+	}
+	return "ws://" + l.Addr().String()
+}
+
+// gatewayAddr returns the address the IRC gateway connects to the server on
+// l with, using a loopback address if it listens on every interface.
+func gatewayAddr(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return "unix://" + l.Addr().String()
+	}
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return l.Addr().String()
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
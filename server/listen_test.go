@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		a       args
+		network string
+		addr    string
+	}{
+		{args{Port: 8080}, "tcp4", "localhost:8080"},
+		{args{Port: 8080, Bind: true}, "tcp4", "0.0.0.0:8080"},
+		{args{Port: 8080, Listen: "[::1]:0"}, "tcp", "[::1]:0"},
+		{args{Listen: ":0"}, "tcp", ":0"},
+		{args{Listen: "unix:/run/go-chat/go-chat.sock"}, "unix", "/run/go-chat/go-chat.sock"},
+		{args{Listen: "unix:///run/go-chat/go-chat.sock"}, "unix", "/run/go-chat/go-chat.sock"},
+	}
+	for _, tt := range tests {
+		if network, addr := listenAddr(tt.a); network != tt.network || addr != tt.addr {
+			t.Errorf("listenAddr(%+v) = %v %v, want %v %v", tt.a, network, addr, tt.network, tt.addr)
+		}
+	}
+}
+
+func TestGatewayAddr(t *testing.T) {
+	tests := []struct {
+		network string
+		addr    string
+		host    string
+	}{
+		{"tcp4", "127.0.0.1:0", "127.0.0.1"},
+		{"tcp4", "0.0.0.0:0", "127.0.0.1"},
+		{"tcp", "[::]:0", "::1"},
+		{"tcp", "[::1]:0", "::1"},
+	}
+	for _, tt := range tests {
+		l, err := net.Listen(tt.network, tt.addr)
+		if err != nil {
+			t.Logf("skipping %v: %v", tt.addr, err)
+			continue
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		if got, want := gatewayAddr(l), net.JoinHostPort(tt.host, port); got != want {
+			t.Errorf("gatewayAddr(%v) = %v, want %v", l.Addr(), got, want)
+		}
+		l.Close()
+	}
+
+	path := filepath.Join(t.TempDir(), "chat.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := gatewayAddr(l); got != "unix://"+path {
+		t.Errorf("gatewayAddr(%v) = %v", path, got)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.sock")
+	a := parseArgs(t, "", "--listen", "unix://"+path)
+	log := slog.New(slog.DiscardHandler)
+
+	// a socket left behind by a killed server is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	listeners, _, err := listen(a, log)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	defer listeners[0].Close()
+
+	// a socket a server listens on is left alone
+	if _, _, err := listen(a, log); err == nil {
+		t.Fatal("listened on a socket in use")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("socket in use was removed: %v", err)
+	}
+	conn.Close()
+}
+
+// TestListenActivated runs the test binary again with listeners passed like
+// systemd does, as file descriptors from 3 named by LISTEN_FDNAMES. The copy
+// prints the addresses listen returns.
+func TestListenActivated(t *testing.T) {
+	if os.Getenv("GO_CHAT_ACTIVATED") != "" {
+		os.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+		a := args{}
+		if os.Getenv("GO_CHAT_ACTIVATED") == "irc-port" {
+			a.IrcPort = 6667
+		}
+		listeners, ircListener, err := listen(a, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(0)
+		}
+		for _, l := range listeners {
+			fmt.Println("serve", l.Addr())
+		}
+		if ircListener != nil {
+			fmt.Println("irc", ircListener.Addr())
+		}
+		os.Exit(0)
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		names []string
+		// lines expected in order in the output, with %N replaced by the
+		// address of listener N
+		want []string
+	}{
+		{"dual stack", "1", []string{"go-chat.socket", "go-chat.socket", "irc"}, []string{"serve %0", "serve %1", "irc %2"}},
+		{"irc first", "1", []string{"irc", "web"}, []string{"serve %1", "irc %0"}},
+		{"no irc socket", "irc-port", []string{"web"}, []string{"irc gateway disabled", "serve %0"}},
+		{"only irc", "1", []string{"irc"}, []string{"error: no socket passed by systemd for the server"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := []string{}
+			files := []*os.File{}
+			for range tt.names {
+				l, err := net.Listen("tcp4", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer l.Close()
+				f, err := l.(*net.TCPListener).File()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				addrs = append(addrs, l.Addr().String())
+				files = append(files, f)
+			}
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestListenActivated$")
+			cmd.Env = append(os.Environ(), "GO_CHAT_ACTIVATED="+tt.mode, "LISTEN_PID=0",
+				fmt.Sprintf("LISTEN_FDS=%v", len(files)), "LISTEN_FDNAMES="+strings.Join(tt.names, ":"))
+			cmd.ExtraFiles = files
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v\n%s", err, out)
+			}
+
+			rest := string(out)
+			for _, line := range tt.want {
+				for i, addr := range addrs {
+					line = strings.ReplaceAll(line, fmt.Sprintf("%%%v", i), addr)
+				}
+				i := strings.Index(rest, line)
+				if i < 0 {
+					t.Fatalf("%q not found in order in\n%s", line, out)
+				}
+				rest = rest[i+len(line):]
+			}
+		})
+	}
+}
@@ -5,64 +5,128 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	c "go-chat/common"
 
-	"github.com/alexflint/go-arg"
 	ws "github.com/coder/websocket"
-	"github.com/coder/websocket/wsjson"
 	"github.com/jmoiron/sqlx"
 	_ "modernc.org/sqlite"
 )
 
 type user struct {
-	room string
-	nick string
+	room  string
+	nick  string
+	addr  string
+	auth  bool
+	codec c.Codec
+	rtt   time.Duration
+	// the nick was claimed on the backplane, guests keep their port unclaimed
+	claimed bool
 }
 
 type conns struct {
 	sm sync.Mutex
+	// nm keeps messages in order while they are numbered, the backplane is
+	// called without holding sm
+	nm sync.Mutex
 	cm map[*ws.Conn]user
+	// numbers guests without a port to use as their nick, e.g. over unix sockets
+	guests int
 }
 
 type server struct {
-	admin string
+	opts  *atomic.Pointer[settings]
 	dbase *sqlx.DB
-	logFn func(string, ...interface{})
+	log   *slog.Logger
 	conns *conns
 	rooms map[string]string
 	rhist map[string][]c.SMsg
+	rnums map[string]int64
+	rttls map[string]time.Duration
 	rhlen int
 	logCh chan<- logMsg
 	nickm map[string]string
+	stats *metrics
+	state *state
+	api   http.Handler
+	read  http.Handler
+	web   http.Handler
+	hooks *webhooks
+	// subscribers to the read API room streams
+	streams *streams
+	// servers linked to share rooms
+	links *links
+	// other instances sharing the database
+	bplane backplane
 }
 
+type logOp int
+
+const (
+	logInsert logOp = iota
+	logUpdate
+	logDelete
+)
+
 type logMsg struct {
 	Ch  string
 	Msg c.SMsg
+	Op  logOp
 }
 
 type args struct {
-	Admin   string  `arg:"-a,env:ADMIN" default:"8bit" help:"admin user nick, allows access to /sudo" placeholder:"NICK"`
-	DB      string  `arg:"-d,env:DB" default:"./go-chat.db" help:"sqlite database to store server data" placeholder:"FILE"`
-	HistLen uint    `arg:"-l,env:HIST_LEN" default:"10" help:"set message history size" placeholder:"N"`
-	Bind    bool    `arg:"-b,env:BIND" default:"false" help:"bind to 0.0.0.0 instead of 127.0.0.1 (localhost)"`
-	Port    uint    `arg:"-p,env:PORT" default:"8080" help:"port to listen on, random available port if not set"`
-	NickMap *string `arg:"-n,env:NICK_MAP" help:"path to nick:pass JSON file" placeholder:"FILE"`
+	Config    *string       `arg:"-c,env:CONFIG" json:"-" help:"path to JSON config file, reloaded on SIGHUP" placeholder:"FILE"`
+	Admin     string        `arg:"-a,env:ADMIN" json:"admin" default:"8bit" help:"admin user nick, allows access to /sudo" placeholder:"NICK"`
+	DB        string        `arg:"-d,env:DB" json:"db" default:"./go-chat.db" help:"sqlite database to store server data" placeholder:"FILE"`
+	HistLen   uint          `arg:"-l,env:HIST_LEN" json:"hist_len" default:"10" help:"set message history size" placeholder:"N"`
+	Bind      bool          `arg:"-b,env:BIND" json:"bind" default:"false" help:"bind to 0.0.0.0 instead of 127.0.0.1 (localhost)"`
+	Port      uint          `arg:"-p,env:PORT" json:"port" default:"8080" help:"port to listen on, random available port if not set"`
+	Listen    string        `arg:"--listen,env:LISTEN" json:"listen" help:"address to listen on instead of --bind and --port, such as [::]:8080 or :8080 for every IPv6 and IPv4 interface, or unix:/run/go-chat/go-chat.sock" placeholder:"ADDR"`
+	NickMap   *string       `arg:"-n,env:NICK_MAP" json:"nick_map" help:"path to nick:pass JSON file" placeholder:"FILE"`
+	LogLvl    slog.Level    `arg:"--log-level,env:LOG_LEVEL" json:"log_level" default:"info" help:"minimum log level [debug, info, warn, error]" placeholder:"LEVEL"`
+	LogFmt    string        `arg:"--log-format,env:LOG_FORMAT" json:"log_format" default:"text" help:"log output format [text, json]" placeholder:"FORMAT"`
+	Redact    bool          `arg:"-r,env:REDACT" json:"redact" default:"false" help:"redact message bodies in logs"`
+	Grace     duration      `arg:"-g,env:GRACE" json:"grace" default:"10s" help:"time allowed on shutdown for requests to finish, then again for clients to disconnect" placeholder:"DURATION"`
+	Motd      string        `arg:"-m,env:MOTD" json:"motd" help:"message of the day, sent to clients when they connect" placeholder:"TEXT"`
+	Rate      float64       `arg:"--rate,env:RATE" json:"rate" default:"0" help:"messages per second allowed per connection, 0 for unlimited" placeholder:"N"`
+	Burst     uint          `arg:"--burst,env:BURST" json:"burst" default:"5" help:"messages allowed in a burst when rate limited" placeholder:"N"`
+	MaxLen    uint          `arg:"--max-len,env:MAX_LEN" json:"max_len" default:"2000" help:"maximum message length in characters" placeholder:"N"`
+	Rooms     []string      `arg:"--rooms,env:ROOMS" json:"rooms" help:"rooms to create when the database is empty [default: general test1 test2]" placeholder:"ROOM"`
+	Compress  c.Compression `arg:"--compression,env:COMPRESSION" json:"compression" default:"no-context" help:"websocket compression [off, context, no-context], context uses more memory per connection but compresses better" placeholder:"MODE"`
+	Threshold uint          `arg:"--compression-threshold,env:COMPRESSION_THRESHOLD" json:"compression_threshold" default:"256" help:"minimum message size in bytes to compress" placeholder:"N"`
+	Origins   []string      `arg:"--origins,env:ORIGINS" json:"origins" help:"origins allowed to connect from browsers, as host patterns such as *.example.com, only the server's own host if not set" placeholder:"PATTERN"`
+	PingInt   duration      `arg:"--ping-interval,env:PING_INTERVAL" json:"ping_interval" default:"30s" help:"time between keepalive pings to clients, 0 to disable" placeholder:"DURATION"`
+	PingWait  duration      `arg:"--ping-timeout,env:PING_TIMEOUT" json:"ping_timeout" default:"10s" help:"time to wait for a pong before closing a connection" placeholder:"DURATION"`
+	ReadLimit uint          `arg:"--read-limit,env:READ_LIMIT" json:"read_limit" default:"32768" help:"maximum size in bytes of a message from a client, larger messages close the connection" placeholder:"N"`
+	Token     string        `arg:"--api-token,env:API_TOKEN" json:"api_token" help:"bearer token for the admin HTTP API under /api/, disabled if not set" placeholder:"TOKEN"`
+	IrcPort   uint          `arg:"--irc-port,env:IRC_PORT" json:"irc_port" help:"port for the IRC gateway, disabled if not set" placeholder:"PORT"`
+	Name      string        `arg:"--server-name,env:SERVER_NAME" json:"server_name" help:"name of this server, shown to linked servers in nicks such as nick@name [default: hostname]" placeholder:"NAME"`
+	LinkToken string        `arg:"--link-token,env:LINK_TOKEN" json:"link_token" help:"shared secret for linking servers, disabled if not set" placeholder:"TOKEN"`
+	Links     []string      `arg:"--links,env:LINKS" json:"links" help:"servers to link to, as ws:// or wss:// URLs" placeholder:"URL"`
+	LinkRooms []string      `arg:"--link-rooms,env:LINK_ROOMS" json:"link_rooms" help:"rooms shared with linked servers that also have them" placeholder:"ROOM"`
+	HubListen string        `arg:"--backplane-listen,env:BACKPLANE_LISTEN" json:"backplane_listen" help:"address to serve the backplane on for other instances using the same database, it is not authenticated so keep it on a private network" placeholder:"HOST:PORT"`
+	Backplane string        `arg:"--backplane,env:BACKPLANE" json:"backplane" help:"address of the backplane served by another instance with --backplane-listen, to act as one server with it" placeholder:"HOST:PORT"`
+	Audit     *string       `arg:"--audit-export" json:"-" help:"write the audit log as JSON lines to FILE (- for stdout) and exit" placeholder:"FILE"`
 }
 
-const createRoomTable = "CREATE TABLE IF NOT EXISTS %s (tim DATETIME, id TEXT, msg TEXT)"
-const insertRoomMsg = "INSERT INTO %v (tim, id, msg) VALUES (:tim, :id, :msg)"
+const createRoomTable = "CREATE TABLE IF NOT EXISTS %s (tim DATETIME, id TEXT, msg TEXT, num INTEGER, typ INTEGER DEFAULT 0, exp DATETIME)"
+const insertRoomMsg = "INSERT INTO %v (tim, id, msg, num, typ, exp) VALUES (:tim, :id, :msg, :num, :typ, :exp)"
+const roomCols = "tim, id, msg, num, typ, exp"
+const selectRoomNum = "SELECT COALESCE(MAX(num), 0) FROM %s"
 
 func (a *args) Version() string {
 	return c.Version
@@ -73,333 +137,934 @@ func (a *args) Description() string {
 }
 
 func main() {
-	log := log.New(os.Stderr, "ws server 🚀 ", log.LstdFlags|log.Lshortfile|log.Lmsgprefix)
-
-	var args args
-	arg.MustParse(&args)
-
-	nickMap, err := loadNickMap(args.NickMap)
+	args, p, err := newParser(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	p.MustParse(os.Args[1:])
+
+	var handler slog.Handler
+	level := &slog.LevelVar{}
+	level.Set(args.LogLvl)
+	opts := &slog.HandlerOptions{Level: level}
+	switch args.LogFmt {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		p.Fail(fmt.Sprintf("invalid log format: %s [text, json]", args.LogFmt))
 	}
+	log := slog.New(handler)
 
-	addr := "localhost:"
-	if args.Bind {
-		addr = "0.0.0.0:"
+	if args.Audit != nil {
+		if err := exportAudit(args.DB, *args.Audit); err != nil {
+			log.Error("audit export failed", "err", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	err = run(addr+fmt.Sprint(args.Port), nickMap, args.Admin, int(args.HistLen), log, args.DB)
+	err = run(*args, log, level)
 	if err != nil {
-		log.Fatal(err)
+		log.Error("server stopped", "err", err)
+		os.Exit(1)
 	}
 }
 
-func run(addr string, nickMap map[string]string, admin string, rhlen int, log *log.Logger, dbPath string) error {
-	listener, err := net.Listen("tcp4", addr)
+func run(a args, log *slog.Logger, level *slog.LevelVar) error {
+	listeners, ircListener, err := listen(a, log)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("listening on ws://%v", listener.Addr())
+	for _, l := range listeners {
+		log.Info("listening", "addr", listenURL(l))
+	}
+
+	if ircListener != nil {
+		defer ircListener.Close()
+		log.Info("irc gateway listening", "addr", ircListener.Addr())
+	}
+
+	if a.Backplane != "" && a.HubListen != "" {
+		return errors.New("--backplane and --backplane-listen can't be used together")
+	}
+	var hubListener net.Listener
+	if a.HubListen != "" {
+		hubListener, err = net.Listen("tcp", a.HubListen)
+		if err != nil {
+			return err
+		}
+		defer hubListener.Close()
+		log.Info("backplane listening", "addr", hubListener.Addr())
+	}
+
+	var bplane backplane
+	if a.Backplane != "" {
+		bplane = dialBackplane(a.Backplane, log)
+	} else {
+		h := newHub()
+		if hubListener != nil {
+			go serveHub(hubListener, h, log)
+		}
+		bplane = h.join()
+	}
+	defer bplane.close()
 
-	db, rooms, rhist, err := loadDb(dbPath, rhlen)
+	handler, err := newServer(a, log, bplane)
 	if err != nil {
 		return err
 	}
+	defer handler.dbase.Close()
 
-	logCh := make(chan logMsg, 128)
-	defer close(logCh)
-	go logMessage(db, rooms, logCh, log)
+	hookCtx, stopHooks := context.WithCancel(context.Background())
+	defer stopHooks()
+	handler.hooks.run(hookCtx)
 
 	server := &http.Server{
-		Handler: server{
-			admin: admin,
-			dbase: db,
-			logFn: log.Printf,
-			conns: &conns{cm: make(map[*ws.Conn]user)},
-			rooms: rooms,
-			rhist: rhist,
-			rhlen: rhlen,
-			logCh: logCh,
-			nickm: nickMap,
-		},
+		Handler:      handler,
+		ConnContext:  connContext,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
+	server.RegisterOnShutdown(handler.streams.closeAll)
 
-	errch := make(chan error, 1)
-	go func() {
-		errch <- server.Serve(listener)
-	}()
+	linkCtx, stopLinks := context.WithCancel(context.Background())
+	defer stopLinks()
+	if a.LinkToken != "" {
+		handler.dialLinks(linkCtx, a.Links)
+	}
+
+	shareCtx, stopSharing := context.WithCancel(context.Background())
+	defer stopSharing()
+	go handler.share(shareCtx)
+	go handler.apply(shareCtx)
+
+	if ircListener != nil {
+		go handler.serveIRC(ircListener, gatewayAddr(listeners[0]))
+	}
+
+	errch := make(chan error, len(listeners))
+	handler.state.serving.Store(true)
+	for _, l := range listeners {
+		go func() {
+			errch <- server.Serve(wireListener{l, handler.stats})
+			handler.state.serving.Store(false)
+		}()
+	}
 
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	select {
-	case err := <-errch:
-		log.Printf("failed to serve: %v", err)
-	case signal := <-signals:
-		log.Printf("quitting: %v", signal)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	grace := time.Duration(a.Grace)
+loop:
+	for {
+		select {
+		case err := <-errch:
+			log.Error("failed to serve", "err", err)
+			break loop
+		case signal := <-signals:
+			if signal == syscall.SIGHUP {
+				if next, err := handler.reload(a, level); err != nil {
+					log.Error("reload failed", "err", err)
+				} else {
+					a, grace = next, time.Duration(next.Grace)
+				}
+				continue
+			}
+			log.Info("quitting", "signal", signal, "grace", grace)
+			break loop
+		}
+	}
+
+	if ircListener != nil {
+		ircListener.Close()
+	}
+	if hubListener != nil {
+		hubListener.Close()
+	}
+	stopLinks()
+	handler.links.closeAll()
+
+	// requests and clients each get the whole grace period, so slow requests
+	// don't leave websockets with none
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	err = server.Shutdown(ctx)
+	cancel()
+	ctx, cancel = context.WithTimeout(context.Background(), grace)
+	handler.closeAll(ctx)
+	cancel()
+	handler.drain()
+	return err
+}
+
+// newServer loads the database for a and returns the server, which saves
+// messages until drain is called. bplane is the backplane it shares rooms
+// with other instances on.
+func newServer(a args, log *slog.Logger, bplane backplane) (server, error) {
+	set, err := newSettings(a)
+	if err != nil {
+		return server{}, err
+	}
+	opts := &atomic.Pointer[settings]{}
+	opts.Store(set)
+
+	name := a.Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	if !validServer(name) {
+		return server{}, fmt.Errorf("invalid server name: %q", name)
+	}
+
+	rhlen := int(a.HistLen)
+	db, rooms, rhist, rnums, err := loadDb(a.DB, rhlen, a.Rooms)
+	if err != nil {
+		return server{}, err
+	}
+
+	rttls, err := loadTtls(db)
+	if err != nil {
+		db.Close()
+		return server{}, err
+	}
+
+	hooks, err := newWebhooks(db, log)
+	if err != nil {
+		db.Close()
+		return server{}, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	logCh := make(chan logMsg, 128)
+
+	s := server{
+		opts:  opts,
+		dbase: db,
+		log:   log,
+		conns: &conns{cm: make(map[*ws.Conn]user)},
+		rooms: rooms,
+		rhist: rhist,
+		rnums: rnums,
+		rttls: rttls,
+		rhlen: rhlen,
+		logCh: logCh,
+		stats: newMetrics(),
+		state: &state{started: time.Now(), logged: make(chan struct{})},
+		hooks: hooks,
+
+		streams: newStreams(),
+		links:   newLinks(name, a.LinkToken, a.LinkRooms, db, log),
+		bplane:  bplane,
+	}
+	s.api = s.apiRoutes()
+	s.read = s.readRoutes()
+	s.web, err = webHandler()
+	if err != nil {
+		db.Close()
+		return server{}, err
+	}
+
+	err = s.loadExpiries()
+	if err != nil {
+		db.Close()
+		return server{}, err
+	}
 
-	return server.Shutdown(ctx)
+	s.state.logging.Store(true)
+	go func() {
+		defer close(s.state.logged)
+		defer s.state.logging.Store(false)
+		logMessage(db, logCh, log, s.stats)
+	}()
+	return s, nil
 }
 
 func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" && r.URL.Path == "/health" {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "go-chat %s is up!", c.Version)
+	if r.Method == "GET" && (r.URL.Path == "/health" || strings.HasPrefix(r.URL.Path, "/health/")) {
+		s.health(w, r)
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/metrics" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+		return
+	}
+
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/hooks/") {
+		s.hook(w, r)
+		return
+	}
+
+	if r.URL.Path == "/link" {
+		s.acceptLink(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		s.api.ServeHTTP(w, r)
+		return
+	}
+
+	if r.URL.Path == "/rooms" || strings.HasPrefix(r.URL.Path, "/rooms/") {
+		s.read.ServeHTTP(w, r)
 		return
 	}
 
 	if r.ProtoAtLeast(1, 1) && !hasUpgradeHeader(r.Header) {
-		http.Redirect(w, r, "https://github.com/supleed2/go-chat", http.StatusSeeOther)
+		s.web.ServeHTTP(w, r)
 		return
 	}
 
 	ctx := r.Context()
-	conn, err := ws.Accept(w, r, nil)
+	cfg := s.cfg()
+	conn, err := ws.Accept(w, r, &ws.AcceptOptions{
+		Subprotocols:         []string{c.ProtocolCBOR, c.Protocol},
+		OriginPatterns:       cfg.origins,
+		CompressionMode:      cfg.compress.Mode(),
+		CompressionThreshold: cfg.threshold,
+	})
 	if err != nil {
-		s.logFn("%v", err)
+		s.log.Warn("accept failed", "addr", r.RemoteAddr, "origin", r.Header.Get("Origin"), "err", err)
 		return
 	}
 	defer conn.CloseNow()
+	conn.SetReadLimit(cfg.readLimit)
+	upgraded(r)
+	codec := meteredCodec{c.CodecFor(conn.Subprotocol()), s.stats}
 
-	if conn.Subprotocol() != "" {
+	// the server does not wait for upgraded connections on shutdown, so they
+	// are counted and added before closeAll can look for them
+	port := s.guestNick(r.RemoteAddr)
+	s.state.mu.Lock()
+	if s.state.closing {
+		s.state.mu.Unlock()
+		conn.Close(ws.StatusServiceRestart, "server restarting")
 		return
 	}
-
-	port := strings.Split(r.RemoteAddr, ":")[1]
+	s.state.wg.Add(1)
 	s.conns.sm.Lock()
-	s.conns.cm[conn] = user{room: "general", nick: port}
+	s.conns.cm[conn] = user{room: "general", nick: port, addr: r.RemoteAddr, codec: codec}
 	s.conns.sm.Unlock()
+	s.state.mu.Unlock()
+	defer s.state.wg.Done()
 	defer func() {
 		s.conns.sm.Lock()
+		u := s.conns.cm[conn]
 		delete(s.conns.cm, conn)
-		s.logFn("Remaining connections: %v", len(s.conns.cm))
+		s.log.Info("remaining connections", "count", len(s.conns.cm))
 		s.conns.sm.Unlock()
+		if u.claimed {
+			s.bplane.release(u.nick)
+		}
 	}()
 
-	s.logFn("connected: %v", r.RemoteAddr)
-	for i := range s.rhist["general"] {
-		wsjson.Write(ctx, conn, s.rhist["general"][i])
+	s.log.Info("connected", "addr", r.RemoteAddr, "protocol", conn.Subprotocol())
+	go s.keepalive(ctx, conn, cfg.pingInterval, cfg.pingTimeout)
+	if conn.Subprotocol() != "" {
+		c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: s.hello(conn.Subprotocol()), Typ: c.Hello})
+		s.sendRooms(ctx, conn, codec, user{nick: port})
+	}
+	s.hooks.emit(event{Event: "join", Room: "general", Nick: port, Tim: time.Now()})
+	if motd := s.cfg().motd; motd != "" {
+		c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: motd, Typ: c.Announce})
+	}
+	for _, m := range s.recent("general") {
+		c.WriteMsg(ctx, conn, codec, m)
 	}
 	cmsg := c.CMsg{}
 	smsg := c.SMsg{Id: port}
+	lim := limiter{}
 	for {
 		err := func(ctx context.Context, conn *ws.Conn) error {
-			err := wsjson.Read(ctx, conn, &cmsg)
+			err := c.ReadMsg(ctx, conn, codec, &cmsg)
 			if err != nil {
 				return err
 			}
+			s.stats.command(cmsg.Typ)
+
+			switch cmsg.Typ {
+			case c.Echo, c.Me, c.Notice, c.Temp, c.NewPoll, c.Cmd:
+				cfg := s.cfg()
+				if !lim.allow(cfg.rate, cfg.burst) {
+					s.log.Warn("rate limited", "nick", smsg.Id)
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: "rate limited, slow down"})
+					return nil
+				}
+				if utf8.RuneCountInString(cmsg.Msg) > cfg.maxLen {
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("message too long, the limit is %v characters", cfg.maxLen)})
+					return nil
+				}
+			}
 
 			switch cmsg.Typ {
 			case c.Sudo:
-				s.logFn("(%v) sudo: %v", smsg.Id, cmsg.Msg)
-				if smsg.Id == s.admin {
+				s.log.Info("sudo", "nick", smsg.Id, "cmd", cmsg.Msg)
+				if smsg.Id == s.cfg().admin {
 					cmd := strings.Split(cmsg.Msg, " ")
 					if len(cmd) == 2 {
-						if cmd[0] == "mk" && cmd[1] != "rooms" {
-							if _, ok := s.rooms[cmd[1]]; ok {
-								wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Room exists: %v", cmd)})
+						if cmd[0] == "mk" {
+							if err := s.mkRoom(cmd[1]); err != nil {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Failed: %v", err)})
 							} else {
-								s.dbase.Exec("INSERT INTO rooms (name) VALUES ($1)", cmd[1])
-								s.dbase.Exec(fmt.Sprintf(createRoomTable, cmd[1]))
-								s.rooms[cmd[1]] = fmt.Sprintf(insertRoomMsg, cmd[1])
-								wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Created room: %v", cmd[1])})
+								s.audit(smsg.Id, "mk", cmd[1], "")
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Created room: %v", cmd[1])})
 							}
 						} else if cmd[0] == "rm" {
-							if _, ok := s.rooms[cmd[1]]; ok && cmd[1] != "general" {
-								delete(s.rooms, cmd[1])
-								s.dbase.Exec("DELETE FROM rooms WHERE name = $1", cmd[1])
-								s.rhist[cmd[1]] = []c.SMsg{}
-								tim := time.Now()
-								s.conns.sm.Lock()
-								for cn, r := range s.conns.cm {
-									if r.room == cmd[1] {
-										r.room = "general"
-										s.conns.cm[cn] = r
-										wsjson.Write(ctx, cn, c.SMsg{Tim: tim, Id: "system", Msg: "room deleted, reconnected to general"})
-									}
-								}
-								s.conns.sm.Unlock()
-								wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Deleted room: %v", cmd[1])})
+							if err := s.rmRoom(ctx, cmd[1]); err != nil {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Failed: %v", err)})
 							} else {
-								wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Room does not exist: %v", cmd[1])})
+								s.audit(smsg.Id, "rm", cmd[1], "")
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Deleted room: %v", cmd[1])})
 							}
 						} else if cmd[0] == "yeet" {
-							found := false
-							s.conns.sm.Lock()
-							for c, r := range s.conns.cm {
-								if r.nick == cmd[1] {
-									c.Close(ws.StatusNormalClosure, "Kicked")
-									found = true
-									break
-								}
+							if s.kick(cmd[1], "Kicked") {
+								s.audit(smsg.Id, "yeet", cmd[1], "")
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Yeet: %v", cmd[1])})
+							} else {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Not found: %v", cmd[1])})
+							}
+						} else if cmd[0] == "ban" {
+							if err := s.ban(cmd[1], ""); err != nil {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Failed: %v", err)})
+							} else {
+								s.audit(smsg.Id, "ban", cmd[1], "")
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Banned: %v", cmd[1])})
 							}
-							s.conns.sm.Unlock()
-							if found {
-								wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Yeet: %v", cmd[1])})
+						} else if cmd[0] == "unban" {
+							if ok, err := s.unban(cmd[1]); err != nil || !ok {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Not banned: %v", cmd[1])})
 							} else {
-								wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Not found: %v", cmd[1])})
+								s.audit(smsg.Id, "unban", cmd[1], "")
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Unbanned: %v", cmd[1])})
 							}
+						} else if cmd[0] == "unhook" {
+							if ok, err := s.rmHook(cmd[1]); err != nil || !ok {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Not found: %v", cmd[1])})
+							} else {
+								s.audit(smsg.Id, "unhook", cmd[1], "")
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Deleted webhook: %v", cmd[1])})
+							}
+						} else if cmd[0] == "rmwebhook" {
+							id, _ := strconv.ParseInt(cmd[1], 10, 64)
+							if ok, err := s.hooks.remove(id); err != nil || !ok {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Not found: %v", cmd[1])})
+							} else {
+								s.audit(smsg.Id, "rmwebhook", cmd[1], "")
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Deleted outgoing webhook: %v", cmd[1])})
+							}
+						} else if cmd[0] == "deliveries" {
+							id, _ := strconv.ParseInt(cmd[1], 10, 64)
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: s.hooks.deliveriesText(id)})
+						} else {
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Invalid command: %v", cmd)})
+						}
+					} else if len(cmd) == 3 && cmd[0] == "ttl" {
+						ttl, err := time.ParseDuration(cmd[2])
+						if cmd[2] == "off" {
+							ttl, err = 0, nil
+						}
+						if !s.hasRoom(cmd[1]) {
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Room does not exist: %v", cmd[1])})
+						} else if err != nil || ttl < 0 || ttl%time.Second != 0 {
+							// ttls are saved in seconds
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Invalid ttl, use whole seconds: %v", cmd[2])})
+						} else if err := s.setTtl(cmd[1], ttl); err != nil {
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Failed: %v", err)})
+						} else {
+							s.audit(smsg.Id, "ttl", cmd[1], ttl.String())
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Default ttl in %v: %v", cmd[1], ttl)})
+						}
+					} else if len(cmd) == 3 && (cmd[0] == "op" || cmd[0] == "deop") {
+						if !s.hasRoom(cmd[1]) {
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Room does not exist: %v", cmd[1])})
+						} else if err := s.setOp(cmd[2], cmd[1], cmd[0] == "op"); err != nil {
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Failed: %v", err)})
+						} else {
+							s.audit(smsg.Id, cmd[0], cmd[2], cmd[1])
+							if cmd[0] == "op" {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Operator in %v: %v", cmd[1], cmd[2])})
+							} else {
+								c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("No longer operator in %v: %v", cmd[1], cmd[2])})
+							}
+						}
+					} else if len(cmd) == 3 && cmd[0] == "hook" {
+						if h, err := s.newHook(cmd[1], cmd[2]); err != nil {
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Failed: %v", err)})
+						} else {
+							s.audit(smsg.Id, "hook", h.Room, h.Name)
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Webhook for %v as %v: /hooks/%v", h.Room, h.nick(), h.Token)})
+						}
+					} else if len(cmd) == 4 && cmd[0] == "webhook" {
+						if !s.hasRoom(cmd[1]) {
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Room does not exist: %v", cmd[1])})
+						} else if h, err := s.hooks.add(cmd[1], cmd[2], cmd[3]); err != nil {
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Failed: %v", err)})
 						} else {
-							wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Invalid command: %v", cmd)})
+							s.audit(smsg.Id, "webhook", h.Room, fmt.Sprintf("%v %v %v", h.Id, h.Events, h.Url))
+							c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Outgoing webhook %v for %v, signing secret: %v", h.Id, h.Room, h.Secret)})
 						}
+					} else if cmd[0] == "webhooks" {
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: s.hooks.text()})
+					} else if cmd[0] == "hooks" {
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: s.hooksText()})
 					} else if cmd[0] == "wc" {
 						s.conns.sm.Lock()
 						wc := len(s.conns.cm)
 						s.conns.sm.Unlock()
-						wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Online: %v", wc)})
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Online: %v", wc)})
+					} else if cmd[0] == "audit" {
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: s.auditText(10)})
 					} else if cmd[0] == "man" {
-						wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: "Available commands: man, mk, rm, wc, yeet"})
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: sudoManText()})
 					} else {
-						wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Invalid command: %v", cmd)})
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("Invalid command: %v", cmd)})
 					}
 				} else {
-					wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: "Unrecognised command, use /man for more info"})
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: "Unrecognised command, use /man for more info"})
 				}
-			case c.Echo:
-				s.logFn("(%v) echo: %v", smsg.Id, cmsg.Msg)
+			case c.Echo, c.Me, c.Notice, c.Temp:
+				s.log.Debug("echo", "nick", smsg.Id, "type", cmsg.Typ.String(), "msg", s.body(cmsg.Msg))
+				text := cmsg.Msg
 				s.conns.sm.Lock()
 				room := s.conns.cm[conn].room
+				ttl := s.rttls[room]
 				s.conns.sm.Unlock()
-				smsg.Tim = time.Now()
-				smsg.Msg = cmsg.Msg
-				s.logCh <- logMsg{room, smsg}
-				if len(s.rhist[room]) < s.rhlen {
-					s.rhist[room] = append(s.rhist[room], smsg)
-				} else {
-					s.rhist[room] = append(s.rhist[room][1:], smsg)
-				}
-				s.conns.sm.Lock()
-				for c, r := range s.conns.cm {
-					if r.room == room {
-						wsjson.Write(ctx, c, &smsg)
+				if cmsg.Typ == c.Temp {
+					dur, rest, _ := strings.Cut(cmsg.Msg, " ")
+					ttl, err = time.ParseDuration(dur)
+					if err != nil || ttl <= 0 || rest == "" {
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("invalid ttl message: %v", cmsg.Msg)})
+						break
 					}
+					text = rest
 				}
-				s.conns.sm.Unlock()
+				smsg.Tim = time.Now()
+				smsg.Msg = text
+				smsg.Typ = msgType(cmsg.Typ)
+				s.post(ctx, room, smsg, ttl)
 			case c.Mv:
-				switch nick, valid := verifyNick(&s, cmsg.Msg); valid {
+				nick, valid := verifyNick(&s, cmsg.Msg)
+				var old, u user
+				if valid == nickOk {
+					old, u, valid = s.setNick(conn, nick)
+				}
+				switch valid {
 				case nickOk:
-					s.logFn("(%v) mv: %v", smsg.Id, cmsg.Msg)
+					s.log.Info("mv", "nick", smsg.Id, "new", nick)
+					if old.claimed {
+						s.bplane.release(old.nick)
+					}
 					smsg.Id = nick
-					s.conns.sm.Lock()
-					u := s.conns.cm[conn]
-					u.nick = smsg.Id
-					s.conns.cm[conn] = u
-					s.conns.sm.Unlock()
-					wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("nick set: %v", nick)})
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("nick set: %v", nick)})
+					sendResult(ctx, conn, codec, c.Nick, nick, c.Done)
+					s.sendRooms(ctx, conn, codec, u)
+					if u.auth {
+						s.sendMark(ctx, conn, u)
+					}
 				case nickUsed:
-					s.logFn("(%v) mv used: %v", smsg.Id, cmsg.Msg)
-					wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("nick in use: %v", cmsg.Msg)})
+					s.log.Info("mv used", "nick", smsg.Id, "new", strings.Split(cmsg.Msg, ":")[0])
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("nick in use: %v", cmsg.Msg)})
+					sendResult(ctx, conn, codec, c.Nick, smsg.Id, c.NickUsed)
 				case nickInvalid:
-					s.logFn("(%v) mv invalid: %v", smsg.Id, cmsg.Msg)
-					wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("invalid nick: %v", cmsg.Msg)})
+					s.log.Info("mv invalid", "nick", smsg.Id, "new", strings.Split(cmsg.Msg, ":")[0])
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("invalid nick: %v", cmsg.Msg)})
+					sendResult(ctx, conn, codec, c.Nick, smsg.Id, c.NickInvalid)
+				case nickBanned:
+					s.log.Info("mv banned", "nick", smsg.Id, "new", nick)
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("nick banned: %v", nick)})
+					sendResult(ctx, conn, codec, c.Nick, smsg.Id, c.NickBanned)
 				}
 			case c.Ls:
-				s.logFn("(%v) ls", smsg.Id)
+				s.log.Debug("ls", "nick", smsg.Id)
 				s.conns.sm.Lock()
-				room := s.conns.cm[conn].room
+				u := s.conns.cm[conn]
 				s.conns.sm.Unlock()
+				room := u.room
+				rooms := s.roomInfo(u)
 				avRooms := ""
-				for r := range s.rooms {
-					avRooms += r + ", "
+				for _, r := range rooms {
+					avRooms += r.Name
+					if r.Unread > 0 {
+						avRooms += fmt.Sprintf(" (%v)", r.Unread)
+					}
+					avRooms += ", "
 				}
-				wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("connected to: %v, available: %v", room, avRooms[:len(avRooms)-2])})
+				if conn.Subprotocol() != "" {
+					writeRooms(ctx, conn, codec, rooms)
+				}
+				c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("connected to: %v, available: %v", room, avRooms[:len(avRooms)-2])})
 			case c.Cd:
-				if _, ok := s.rooms[cmsg.Msg]; ok {
-					s.logFn("(%v) cd: %v", smsg.Id, cmsg.Msg)
+				if s.hasRoom(cmsg.Msg) {
+					s.log.Info("cd", "nick", smsg.Id, "room", cmsg.Msg)
 					s.conns.sm.Lock()
 					u := s.conns.cm[conn]
 					u.room = cmsg.Msg
 					s.conns.cm[conn] = u
 					s.conns.sm.Unlock()
-					wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("connected to: %v", u.room)})
-					recentHistory := s.rhist[u.room]
-					for i := range recentHistory {
-						wsjson.Write(ctx, conn, recentHistory[i])
+					s.hooks.emit(event{Event: "join", Room: u.room, Nick: u.nick, Tim: time.Now()})
+					sendResult(ctx, conn, codec, c.Room, u.room, c.Done)
+					s.sendRooms(ctx, conn, codec, u)
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("connected to: %v", u.room)})
+					if pins, err := s.pins(u.room); err == nil && len(pins) > 0 {
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: pinsText(u.room, pins)})
+					}
+					s.conns.sm.Lock()
+					ttl := s.rttls[u.room]
+					s.conns.sm.Unlock()
+					if ttl > 0 {
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("messages in %v expire after %v", u.room, ttl)})
 					}
+					for _, m := range s.recent(u.room) {
+						c.WriteMsg(ctx, conn, codec, m)
+					}
+					s.sendMark(ctx, conn, u)
 				} else {
-					s.logFn("(%v) cd invalid: %v", smsg.Id, cmsg.Msg)
-					wsjson.Write(ctx, conn, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("unchanged, invalid room: %v", cmsg.Msg)})
+					s.log.Info("cd invalid", "nick", smsg.Id, "room", cmsg.Msg)
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("unchanged, invalid room: %v", cmsg.Msg)})
+					s.conns.sm.Lock()
+					room := s.conns.cm[conn].room
+					s.conns.sm.Unlock()
+					sendResult(ctx, conn, codec, c.Room, room, c.RoomInvalid)
 				}
 			case c.Who:
 				s.conns.sm.Lock()
 				room := s.conns.cm[conn].room
-				s.logFn("(%v) who: %v", smsg.Id, room)
-				users := fmt.Sprintf("users in %v: ", room)
-				for _, r := range s.conns.cm {
-					if r.room == room {
-						users += fmt.Sprintf("%v, ", r.nick)
+				s.conns.sm.Unlock()
+				s.log.Debug("who", "nick", smsg.Id, "room", room)
+				users := strings.Join(s.roomUsers(room), ", ")
+				c.WriteMsg(ctx, conn, codec, &c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("users in %v: %v", room, users)})
+			case c.Pin, c.Unpin:
+				s.conns.sm.Lock()
+				u := s.conns.cm[conn]
+				s.conns.sm.Unlock()
+				num, err := strconv.ParseInt(strings.TrimPrefix(cmsg.Msg, "#"), 10, 64)
+				if err != nil {
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("invalid message id: %v", cmsg.Msg)})
+					break
+				}
+				if !s.isOp(u, u.room) {
+					s.log.Warn("pin denied", "nick", smsg.Id, "room", u.room, "num", num)
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("not an operator in %v", u.room)})
+					break
+				}
+				if cmsg.Typ == c.Pin {
+					s.log.Info("pin", "nick", smsg.Id, "room", u.room, "num", num)
+					pinned, err := s.pin(u, num)
+					if err != nil {
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: err.Error()})
+						break
+					}
+					s.audit(u.nick, "pin", u.room, fmt.Sprint(num))
+					s.broadcast(ctx, u.room, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("%v pinned #%v %v: %v", u.nick, num, pinned.Id, pinned.Msg), Typ: c.Announce})
+				} else {
+					s.log.Info("unpin", "nick", smsg.Id, "room", u.room, "num", num)
+					if ok, err := s.unpin(u, num); err != nil || !ok {
+						c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("not pinned: #%v", num)})
+						break
 					}
+					s.audit(u.nick, "unpin", u.room, fmt.Sprint(num))
+					s.broadcast(ctx, u.room, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("%v unpinned #%v", u.nick, num), Typ: c.Announce})
+				}
+			case c.Pins:
+				s.conns.sm.Lock()
+				room := s.conns.cm[conn].room
+				s.conns.sm.Unlock()
+				s.log.Debug("pins", "nick", smsg.Id, "room", room)
+				pins, err := s.pins(room)
+				if err != nil {
+					s.log.Error("pins", "nick", smsg.Id, "room", room, "err", err)
+				}
+				c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: pinsText(room, pins)})
+			case c.NewPoll:
+				s.conns.sm.Lock()
+				u := s.conns.cm[conn]
+				s.conns.sm.Unlock()
+				s.log.Debug("poll", "nick", smsg.Id, "room", u.room, "msg", s.body(cmsg.Msg))
+				poll, ok := parsePoll(cmsg.Msg)
+				if !ok {
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: "usage: /poll \"question\" option1 option2 ..."})
+					break
+				}
+				if err := s.newPoll(ctx, u, poll); err != nil {
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: fmt.Sprintf("poll failed: %v", err)})
+				}
+			case c.Vote, c.ClosePoll:
+				s.conns.sm.Lock()
+				u := s.conns.cm[conn]
+				s.conns.sm.Unlock()
+				s.log.Debug("vote", "nick", smsg.Id, "type", cmsg.Typ.String(), "args", cmsg.Msg)
+				var err error
+				if cmsg.Typ == c.Vote {
+					err = s.vote(ctx, u, cmsg.Msg)
+				} else {
+					err = s.closePoll(ctx, u, cmsg.Msg)
+				}
+				if err != nil {
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: err.Error()})
+				}
+			case c.Cmd:
+				s.conns.sm.Lock()
+				u := s.conns.cm[conn]
+				s.conns.sm.Unlock()
+				reply, err := s.runCommand(ctx, u, cmsg.Msg)
+				if err != nil {
+					reply = err.Error()
+				}
+				if reply != "" {
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: reply})
+				}
+			case c.Cmds:
+				if conn.Subprotocol() != "" {
+					c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: commandList(), Typ: c.Commands})
+				}
+			case c.Read:
+				num, err := strconv.ParseInt(cmsg.Msg, 10, 64)
+				if err != nil {
+					s.log.Warn("read invalid", "nick", smsg.Id, "num", cmsg.Msg)
+					break
+				}
+				s.conns.sm.Lock()
+				u := s.conns.cm[conn]
+				if num > s.rnums[u.room] {
+					num = s.rnums[u.room]
 				}
 				s.conns.sm.Unlock()
-				wsjson.Write(ctx, conn, &c.SMsg{Tim: time.Now(), Id: "system", Msg: users[:len(users)-2]})
+				if err := s.setMark(u, num); err != nil {
+					s.log.Error("read", "nick", smsg.Id, "err", err)
+				}
 			}
 			return nil
 		}(ctx, conn)
 
-		if ws.CloseStatus(err) == ws.StatusNormalClosure {
-			s.logFn("disconnected: %v", r.RemoteAddr)
+		if status := ws.CloseStatus(err); status == ws.StatusNormalClosure || status == ws.StatusServiceRestart {
+			s.log.Info("disconnected", "addr", r.RemoteAddr)
 			return
 		}
 		if err != nil {
-			s.logFn("failed, addr %v: %v", r.RemoteAddr, err)
+			s.log.Warn("connection failed", "addr", r.RemoteAddr, "err", err)
 			return
 		}
 	}
 }
 
-func loadDb(path string, rhlen int) (*sqlx.DB, map[string]string, map[string][]c.SMsg, error) {
-	db, err := sqlx.Connect("sqlite", path)
+func msgType(t c.CMsgT) c.SMsgT {
+	switch t {
+	case c.Me:
+		return c.Action
+	case c.Notice:
+		return c.Note
+	default:
+		return c.Text
+	}
+}
+
+// post numbers smsg and adds it to the history of room, then saves and
+// broadcasts it. Messages expire after ttl if it is positive. It returns false
+// if a plugin filter dropped the message.
+func (s server) post(ctx context.Context, room string, smsg c.SMsg, ttl time.Duration) (c.SMsg, bool) {
+	for _, f := range plugins.filters {
+		if !f(ctx, s, room, &smsg) {
+			return smsg, false
+		}
+	}
+
+	smsg.Exp = nil
+	if ttl > 0 {
+		exp := smsg.Tim.Add(ttl)
+		smsg.Exp = &exp
+	}
+	s.conns.nm.Lock()
+	smsg.Num = s.nextNum(room)
+	s.conns.sm.Lock()
+	s.rnums[room] = max(s.rnums[room], smsg.Num)
+	if len(s.rhist[room]) < s.rhlen {
+		s.rhist[room] = append(s.rhist[room], smsg)
+	} else {
+		s.rhist[room] = append(s.rhist[room][1:], smsg)
+	}
+	// relay while numbering so linked servers get messages in order
+	s.links.relay(room, smsg)
+	s.conns.sm.Unlock()
+	s.conns.nm.Unlock()
+	s.queue(logMsg{Ch: room, Msg: smsg})
+	s.stats.message(room)
+	if ttl > 0 {
+		s.expireAfter(room, smsg.Num, ttl)
+	}
+	s.broadcast(ctx, room, smsg)
+	if smsg.Exp == nil {
+		s.hooks.emit(event{Event: "message", Room: room, Nick: smsg.Id, Msg: &smsg, Tim: smsg.Tim})
+	}
+	for _, f := range plugins.listeners {
+		f(ctx, s, room, smsg)
+	}
+	return smsg, true
+}
+
+// nextNum returns the next message number in room, the caller must hold
+// conns.nm. It does not hold conns.sm while the backplane numbers it, which
+// may wait on the network.
+func (s server) nextNum(room string) int64 {
+	s.conns.sm.Lock()
+	num := s.rnums[room]
+	s.conns.sm.Unlock()
+	return s.bplane.next(room, num)
+}
+
+// broadcast sends smsg to the users in room on every instance.
+func (s server) broadcast(ctx context.Context, room string, smsg c.SMsg) {
+	s.bplane.publish(bpEvent{Kind: "msg", Room: room, Msg: &smsg})
+	s.deliver(ctx, room, smsg)
+}
+
+// deliver sends smsg to the users in room on this instance.
+// typed reports whether messages of type t are only sent to clients that
+// negotiated a subprotocol, since older clients would show them as text.
+func typed(t c.SMsgT) bool {
+	return t == c.Mark || t == c.Expire || t == c.Commands || t == c.Hello || t == c.Nick || t == c.Room || t == c.Rooms
+}
+
+func (s server) deliver(ctx context.Context, room string, smsg c.SMsg) {
+	defer s.stats.broadcast(time.Now())
+	s.streams.publish(room, smsg)
+	frames := make(map[c.Codec][]byte)
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	for conn, r := range s.conns.cm {
+		if r.room != room || typed(smsg.Typ) && conn.Subprotocol() == "" {
+			continue
+		}
+		// encode once for each codec in use, Marshal only counts the first
+		data, ok := frames[r.codec]
+		if !ok {
+			data, _ = r.codec.Marshal(&smsg)
+			frames[r.codec] = data
+		} else {
+			s.stats.payload(len(data), 0)
+		}
+		conn.Write(ctx, r.codec.MessageType(), data)
+	}
+}
+
+const createRoomsTable = "CREATE TABLE IF NOT EXISTS rooms (name TEXT, ttl INTEGER DEFAULT 0)"
+
+// schema creates the tables of the server, next to the rooms which are stored
+// as tables too, so their names are reserved.
+var schema = []string{createRoomsTable, createMarksTable, createOpsTable, createPinsTable, createPollsTable, createVotesTable, createAuditTable, auditNoUpdate, auditNoDelete, createBansTable, createHooksTable, createWebhooksTable, createDeliveriesTable, createLinksTable}
+
+func loadDb(path string, rhlen int, seed []string) (*sqlx.DB, map[string]string, map[string][]c.SMsg, map[string]int64, error) {
+	// wait for locks rather than failing, messages, the audit log and webhook
+	// deliveries are written from different goroutines
+	db, err := sqlx.Connect("sqlite", path+"?_pragma=busy_timeout(5000)")
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
+	}
+
+	for _, table := range schema {
+		_, err = db.Exec(table)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS rooms (name TEXT)")
+	_, err = addColumn(db, "rooms", "ttl", "INTEGER DEFAULT 0")
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	roomList := []string{}
-	err = db.Select(&roomList, "SELECT * FROM rooms")
+	err = db.Select(&roomList, "SELECT name FROM rooms")
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	if len(roomList) == 0 {
-		roomList = []string{"general", "test1", "test2"}
-		_, err = db.Exec("INSERT INTO rooms (name) VALUES ('general'), ('test1'), ('test2')")
-		if err != nil {
-			return nil, nil, nil, err
+		roomList = seed
+		if len(roomList) == 0 {
+			roomList = []string{"general", "test1", "test2"}
+		}
+		if !slices.Contains(roomList, "general") {
+			roomList = append([]string{"general"}, roomList...)
+		}
+		for _, room := range roomList {
+			if !validRoom(room) {
+				return nil, nil, nil, nil, fmt.Errorf("invalid room name: %v", room)
+			}
+			_, err = db.Exec("INSERT INTO rooms (name) VALUES ($1)", room)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
 		}
 	}
 
 	rooms := make(map[string]string)
 	rhist := make(map[string][]c.SMsg)
+	rnums := make(map[string]int64)
 
 	for _, room := range roomList {
 		rooms[room] = fmt.Sprintf(insertRoomMsg, room)
 
 		_, err = db.Exec(fmt.Sprintf(createRoomTable, room))
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
+		}
+
+		added, err := addColumn(db, room, "num", "INTEGER")
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if added {
+			_, err = db.Exec(fmt.Sprintf("UPDATE %s SET num = rowid", room))
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+
+		_, err = addColumn(db, room, "typ", "INTEGER DEFAULT 0")
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		_, err = addColumn(db, room, "exp", "DATETIME")
+		if err != nil {
+			return nil, nil, nil, nil, err
 		}
 
 		roomHistory := []c.SMsg{}
-		err = db.Select(&roomHistory, fmt.Sprintf("SELECT * FROM %s ORDER BY tim DESC LIMIT %d", room, rhlen))
+		err = db.Select(&roomHistory, fmt.Sprintf("SELECT %s FROM %s ORDER BY num DESC LIMIT %d", roomCols, room, rhlen))
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 
 		slices.Reverse(roomHistory)
 		rhist[room] = roomHistory
+
+		var num int64
+		err = db.Get(&num, fmt.Sprintf(selectRoomNum, room))
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		rnums[room] = num
+	}
+
+	return db, rooms, rhist, rnums, nil
+}
+
+func addColumn(db *sqlx.DB, table string, column string, def string) (bool, error) {
+	var n int
+	err := db.Get(&n, "SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, column)
+	if err != nil || n > 0 {
+		return false, err
 	}
 
-	return db, rooms, rhist, nil
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
 type nickErr int
@@ -408,28 +1073,78 @@ const (
 	nickOk nickErr = iota
 	nickUsed
 	nickInvalid
+	nickBanned
 )
 
+// guestNick returns the nick of a new connection from addr, its port, or a
+// number if it has none.
+func (s server) guestNick(addr string) string {
+	if _, port, err := net.SplitHostPort(addr); err == nil && port != "" {
+		return port
+	}
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	s.conns.guests++
+	return fmt.Sprint(s.conns.guests)
+}
+
 func verifyNick(s *server, n string) (string, nickErr) {
 	nick, pass, _ := strings.Cut(n, ":")
 
+	if s.banned(nick) {
+		return nick, nickBanned
+	}
+
 	s.conns.sm.Lock()
-	defer s.conns.sm.Unlock()
-	for _, u := range s.conns.cm {
-		if u.nick == nick {
-			return "", nickUsed
-		}
+	used := s.nickTaken(nick)
+	s.conns.sm.Unlock()
+	if used {
+		return "", nickUsed
 	}
 
-	expPass, needAuth := s.nickm[nick]
+	expPass, needAuth := s.cfg().nickm[nick]
 
 	if (!needAuth || pass == expPass) && alphanumeric(nick) {
+		// the nick may be in use on another instance, the backplane is called
+		// without conns.sm as it may wait on the network
+		if !s.bplane.claim(nick) {
+			return "", nickUsed
+		}
 		return nick, nickOk
 	} else {
 		return "", nickInvalid
 	}
 }
 
+// nickTaken reports whether a connection uses nick, the caller must hold
+// conns.sm.
+func (s server) nickTaken(nick string) bool {
+	for _, u := range s.conns.cm {
+		if u.nick == nick {
+			return true
+		}
+	}
+	return false
+}
+
+// setNick sets the nick of conn to a verified nick, unless another connection
+// took it while it was claimed. It returns the user before and after.
+func (s server) setNick(conn *ws.Conn, nick string) (user, user, nickErr) {
+	_, auth := s.cfg().nickm[nick]
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	old := s.conns.cm[conn]
+	if s.nickTaken(nick) {
+		return old, old, nickUsed
+	}
+	u := old
+	u.nick = nick
+	u.auth = auth
+	u.claimed = true
+	s.conns.cm[conn] = u
+	return old, u, nickOk
+}
+
 func loadNickMap(m *string) (map[string]string, error) {
 	nm := make(map[string]string)
 	if m == nil {
@@ -480,10 +1195,21 @@ func hasUpgradeHeader(h http.Header) bool {
 	return false
 }
 
-func logMessage(db *sqlx.DB, rooms map[string]string, logCh <-chan logMsg, log *log.Logger) {
+func logMessage(db *sqlx.DB, logCh <-chan logMsg, log *slog.Logger, stats *metrics) {
 	for msg := range logCh {
-		if _, err := db.NamedExec(rooms[msg.Ch], msg.Msg); err != nil {
-			log.Println("logMessage:", err)
+		start := time.Now()
+		var err error
+		switch msg.Op {
+		case logInsert:
+			_, err = db.NamedExec(fmt.Sprintf(insertRoomMsg, msg.Ch), msg.Msg)
+		case logUpdate:
+			_, err = db.Exec(fmt.Sprintf("UPDATE %s SET msg = $1 WHERE num = $2", msg.Ch), msg.Msg.Msg, msg.Msg.Num)
+		case logDelete:
+			err = deleteMessage(db, msg.Ch, msg.Msg.Num)
+		}
+		stats.dbWrite(time.Since(start), err)
+		if err != nil {
+			log.Error("logMessage", "room", msg.Ch, "num", msg.Msg.Num, "err", err)
 		}
 	}
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+)
+
+// testServer starts a server for the command line argv, with its database in
+// a temporary directory, and stops it when the test ends.
+func testServer(t *testing.T, argv ...string) (server, *httptest.Server) {
+	t.Helper()
+	return testInstance(t, newHub().join(), argv...)
+}
+
+// testInstance starts a server like testServer, joined to other instances
+// through bplane.
+func testInstance(t *testing.T, bplane backplane, argv ...string) (server, *httptest.Server) {
+	t.Helper()
+	a := parseArgs(t, "", append([]string{"--db", filepath.Join(t.TempDir(), "chat.db")}, argv...)...)
+	s, err := newServer(a, slog.New(slog.DiscardHandler), bplane)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hooks.run(t.Context())
+
+	ts := httptest.NewUnstartedServer(s)
+	ts.Listener = wireListener{ts.Listener, s.stats}
+	ts.Config.ConnContext = connContext
+	ts.Config.RegisterOnShutdown(s.streams.closeAll)
+	ts.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.links.closeAll()
+		s.closeAll(ctx)
+		ts.Close()
+		s.drain()
+		s.dbase.Close()
+		bplane.close()
+	})
+	return s, ts
+}
+
+type testClient struct {
+	t     *testing.T
+	conn  *ws.Conn
+	codec c.Codec
+	msgs  chan c.SMsg
+}
+
+// dialTest connects a client to the websocket server at url.
+func dialTest(t *testing.T, url string) *testClient {
+	t.Helper()
+	return dialProtocol(t, url, c.Protocol)
+}
+
+// dialProtocol connects a client using protocol, or none like older clients
+// if it is empty.
+func dialProtocol(t *testing.T, url string, protocol string) *testClient {
+	t.Helper()
+	opts := &ws.DialOptions{}
+	if protocol != "" {
+		opts.Subprotocols = []string{protocol}
+	}
+	url = "ws" + strings.TrimPrefix(url, "http")
+	conn, _, err := ws.Dial(t.Context(), url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+
+	tc := &testClient{t: t, conn: conn, codec: c.CodecFor(conn.Subprotocol()), msgs: make(chan c.SMsg, 64)}
+	go func() {
+		defer close(tc.msgs)
+		for {
+			var m c.SMsg
+			if err := c.ReadMsg(context.Background(), conn, tc.codec, &m); err != nil {
+				return
+			}
+			tc.msgs <- m
+		}
+	}()
+	if protocol != "" {
+		tc.wait(func(m c.SMsg) bool { return m.Typ == c.Hello })
+	}
+	return tc
+}
+
+func (tc *testClient) send(typ c.CMsgT, msg string) {
+	tc.t.Helper()
+	if err := c.WriteMsg(tc.t.Context(), tc.conn, tc.codec, c.CMsg{Typ: typ, Msg: msg}); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// wait returns the first message that matches, skipping the others.
+func (tc *testClient) wait(match func(c.SMsg) bool) c.SMsg {
+	tc.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-tc.msgs:
+			if !ok {
+				tc.t.Fatal("connection closed")
+			}
+			if match(m) {
+				return m
+			}
+		case <-timeout:
+			tc.t.Fatal("timed out waiting for a message")
+		}
+	}
+}
+
+// waitText waits for a message containing text.
+func (tc *testClient) waitText(text string) c.SMsg {
+	tc.t.Helper()
+	return tc.wait(func(m c.SMsg) bool { return strings.Contains(m.Msg, text) })
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+)
+
+const createMarksTable = "CREATE TABLE IF NOT EXISTS marks (nick TEXT, room TEXT, num INTEGER, PRIMARY KEY (nick, room))"
+const upsertMark = "INSERT INTO marks (nick, room, num) VALUES ($1, $2, $3) ON CONFLICT (nick, room) DO UPDATE SET num = excluded.num WHERE excluded.num > marks.num"
+
+func (s server) readMark(u user, room string) (int64, bool) {
+	if !u.auth {
+		return 0, false
+	}
+
+	var num int64
+	if err := s.dbase.Get(&num, "SELECT num FROM marks WHERE nick = $1 AND room = $2", u.nick, room); err != nil {
+		return 0, false
+	}
+
+	return num, true
+}
+
+func (s server) setMark(u user, num int64) error {
+	if !u.auth || num <= 0 {
+		return nil
+	}
+
+	_, err := s.dbase.Exec(upsertMark, u.nick, u.room, num)
+	return err
+}
+
+func (s server) sendMark(ctx context.Context, conn *ws.Conn, u user) {
+	if conn.Subprotocol() == "" {
+		return
+	}
+	if num, ok := s.readMark(u, u.room); ok {
+		c.WriteMsg(ctx, conn, u.codec, c.SMsg{Tim: time.Now(), Id: "system", Typ: c.Mark, Num: num})
+	}
+}
+
+func (s server) unread(u user, room string) int64 {
+	if !u.auth {
+		return 0
+	}
+	// every message is unread in rooms that have never been opened
+	num, _ := s.readMark(u, room)
+
+	var n int64
+	if err := s.dbase.Get(&n, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE num > $1", room), num); err != nil {
+		return 0
+	}
+
+	return n
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	c "go-chat/common"
+)
+
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, b := range latencyBuckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %v\n", name, b, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %v\n%s_sum %v\n%s_count %v\n", name, h.count, name, h.sum, name, h.count)
+}
+
+type metrics struct {
+	mu       sync.Mutex
+	messages map[string]uint64
+	commands map[c.CMsgT]uint64
+	dbErrors uint64
+	reaped   uint64
+	// websocket bytes sent and received, as encoded messages and on the wire
+	// after compression and framing
+	msgBytes  [2]uint64
+	wireBytes [2]uint64
+	dbWrites  histogram
+	fanout    histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		messages: make(map[string]uint64),
+		commands: make(map[c.CMsgT]uint64),
+	}
+}
+
+func (m *metrics) message(room string) {
+	m.mu.Lock()
+	m.messages[room]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) command(t c.CMsgT) {
+	m.mu.Lock()
+	m.commands[t]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) dbWrite(d time.Duration, err error) {
+	m.mu.Lock()
+	m.dbWrites.observe(d.Seconds())
+	if err != nil {
+		m.dbErrors++
+	}
+	m.mu.Unlock()
+}
+
+func (m *metrics) payload(sent int, received int) {
+	m.mu.Lock()
+	m.msgBytes[0] += uint64(sent)
+	m.msgBytes[1] += uint64(received)
+	m.mu.Unlock()
+}
+
+func (m *metrics) wire(sent int, received int) {
+	m.mu.Lock()
+	m.wireBytes[0] += uint64(sent)
+	m.wireBytes[1] += uint64(received)
+	m.mu.Unlock()
+}
+
+func (m *metrics) reap() {
+	m.mu.Lock()
+	m.reaped++
+	m.mu.Unlock()
+}
+
+func (m *metrics) broadcast(start time.Time) {
+	d := time.Since(start)
+	m.mu.Lock()
+	m.fanout.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+func (s server) writeMetrics(w io.Writer) {
+	s.conns.sm.Lock()
+	total := len(s.conns.cm)
+	clients := make(map[string]int)
+	for _, u := range s.conns.cm {
+		clients[u.room]++
+	}
+	s.conns.sm.Unlock()
+
+	fmt.Fprintf(w, "# HELP gochat_info Server version.\n# TYPE gochat_info gauge\ngochat_info{version=%q} 1\n", c.Version)
+	fmt.Fprintf(w, "# HELP gochat_connected_clients Number of connected clients.\n# TYPE gochat_connected_clients gauge\ngochat_connected_clients %v\n", total)
+
+	fmt.Fprintf(w, "# HELP gochat_room_clients Number of connected clients per room.\n# TYPE gochat_room_clients gauge\n")
+	for _, room := range slices.Sorted(maps.Keys(clients)) {
+		fmt.Fprintf(w, "gochat_room_clients{room=%q} %v\n", room, clients[room])
+	}
+
+	fmt.Fprintf(w, "# HELP gochat_log_queue_depth Messages waiting to be written to the database.\n# TYPE gochat_log_queue_depth gauge\ngochat_log_queue_depth %v\n", len(s.logCh))
+
+	m := s.stats
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP gochat_room_messages_total Messages sent per room.\n# TYPE gochat_room_messages_total counter\n")
+	for _, room := range slices.Sorted(maps.Keys(m.messages)) {
+		fmt.Fprintf(w, "gochat_room_messages_total{room=%q} %v\n", room, m.messages[room])
+	}
+
+	fmt.Fprintf(w, "# HELP gochat_commands_total Client messages received per type.\n# TYPE gochat_commands_total counter\n")
+	for _, t := range slices.Sorted(maps.Keys(m.commands)) {
+		fmt.Fprintf(w, "gochat_commands_total{type=%q} %v\n", t, m.commands[t])
+	}
+
+	fmt.Fprintf(w, "# HELP gochat_reaped_connections_total Connections closed after a keepalive ping timed out.\n# TYPE gochat_reaped_connections_total counter\ngochat_reaped_connections_total %v\n", m.reaped)
+
+	fmt.Fprintf(w, "# HELP gochat_ws_message_bytes_total Size of websocket messages before compression.\n# TYPE gochat_ws_message_bytes_total counter\n")
+	fmt.Fprintf(w, "gochat_ws_message_bytes_total{direction=\"sent\"} %v\ngochat_ws_message_bytes_total{direction=\"received\"} %v\n", m.msgBytes[0], m.msgBytes[1])
+	fmt.Fprintf(w, "# HELP gochat_ws_wire_bytes_total Bytes sent and received on websocket connections, including compression and framing.\n# TYPE gochat_ws_wire_bytes_total counter\n")
+	fmt.Fprintf(w, "gochat_ws_wire_bytes_total{direction=\"sent\"} %v\ngochat_ws_wire_bytes_total{direction=\"received\"} %v\n", m.wireBytes[0], m.wireBytes[1])
+
+	fmt.Fprintf(w, "# HELP gochat_db_errors_total Failed database writes.\n# TYPE gochat_db_errors_total counter\ngochat_db_errors_total %v\n", m.dbErrors)
+	m.dbWrites.write(w, "gochat_db_write_seconds", "Database write latency.")
+	m.fanout.write(w, "gochat_broadcast_seconds", "Time taken to fan out a message to a room.")
+}
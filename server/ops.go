@@ -0,0 +1,29 @@
+package main
+
+const createOpsTable = "CREATE TABLE IF NOT EXISTS ops (nick TEXT, room TEXT, PRIMARY KEY (nick, room))"
+
+func (s server) isOp(u user, room string) bool {
+	if !u.auth {
+		return false
+	}
+	if u.nick == s.cfg().admin {
+		return true
+	}
+
+	var n int
+	if err := s.dbase.Get(&n, "SELECT COUNT(*) FROM ops WHERE nick = $1 AND room = $2", u.nick, room); err != nil {
+		return false
+	}
+
+	return n > 0
+}
+
+func (s server) setOp(nick string, room string, op bool) error {
+	var err error
+	if op {
+		_, err = s.dbase.Exec("INSERT OR IGNORE INTO ops (nick, room) VALUES ($1, $2)", nick, room)
+	} else {
+		_, err = s.dbase.Exec("DELETE FROM ops WHERE nick = $1 AND room = $2", nick, room)
+	}
+	return err
+}
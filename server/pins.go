@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	c "go-chat/common"
+)
+
+const createPinsTable = "CREATE TABLE IF NOT EXISTS pins (room TEXT, num INTEGER, nick TEXT, tim DATETIME, PRIMARY KEY (room, num))"
+
+func (s server) pin(u user, num int64) (c.SMsg, error) {
+	smsg, err := s.message(u.room, num)
+	if err != nil {
+		return smsg, err
+	}
+
+	_, err = s.dbase.Exec("INSERT OR IGNORE INTO pins (room, num, nick, tim) VALUES ($1, $2, $3, $4)", u.room, num, u.nick, time.Now())
+	return smsg, err
+}
+
+// message returns message num in room, from the recent history first as
+// messages are saved to the database in the background.
+func (s server) message(room string, num int64) (c.SMsg, error) {
+	s.conns.sm.Lock()
+	i := slices.IndexFunc(s.rhist[room], func(m c.SMsg) bool { return m.Num == num })
+	if i >= 0 {
+		smsg := s.rhist[room][i]
+		s.conns.sm.Unlock()
+		return smsg, nil
+	}
+	s.conns.sm.Unlock()
+
+	smsg := c.SMsg{}
+	err := s.dbase.Get(&smsg, fmt.Sprintf("SELECT %s FROM %s WHERE num = $1", roomCols, room), num)
+	if err != nil {
+		return smsg, fmt.Errorf("message not found: #%v", num)
+	}
+	return smsg, nil
+}
+
+func (s server) unpin(u user, num int64) (bool, error) {
+	res, err := s.dbase.Exec("DELETE FROM pins WHERE room = $1 AND num = $2", u.room, num)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s server) pins(room string) ([]c.SMsg, error) {
+	pins := []c.SMsg{}
+	err := s.dbase.Select(&pins, fmt.Sprintf("SELECT m.tim, m.id, m.msg, m.num, m.typ, m.exp FROM pins p JOIN %s m ON m.num = p.num WHERE p.room = $1 ORDER BY p.tim", room), room)
+	return pins, err
+}
+
+func pinsText(room string, pins []c.SMsg) string {
+	if len(pins) == 0 {
+		return fmt.Sprintf("no pinned messages in %v", room)
+	}
+
+	text := fmt.Sprintf("pinned in %v:", room)
+	for _, p := range pins {
+		text += fmt.Sprintf("\n  #%v %v: %v", p.Num, p.Id, p.Msg)
+	}
+	return text
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	c "go-chat/common"
+)
+
+const createPollsTable = "CREATE TABLE IF NOT EXISTS polls (room TEXT, num INTEGER, nick TEXT, tim DATETIME, question TEXT, opts TEXT, open INTEGER, PRIMARY KEY (room, num))"
+const createVotesTable = "CREATE TABLE IF NOT EXISTS votes (room TEXT, num INTEGER, nick TEXT, opt INTEGER, PRIMARY KEY (room, num, nick))"
+
+type poll struct {
+	Room     string
+	Num      int64
+	Nick     string
+	Tim      time.Time
+	Question string
+	Opts     string
+	Open     bool
+}
+
+func parsePoll(s string) (poll, bool) {
+	args := splitArgs(s)
+	if len(args) < 3 {
+		return poll{}, false
+	}
+
+	opts, err := json.Marshal(args[1:])
+	if err != nil {
+		return poll{}, false
+	}
+
+	return poll{Question: args[0], Opts: string(opts), Open: true}, true
+}
+
+func splitArgs(s string) []string {
+	args := []string{}
+	cur, quoted, started := "", false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted, started = !quoted, true
+		case r == ' ' && !quoted:
+			if started {
+				args = append(args, cur)
+			}
+			cur, started = "", false
+		default:
+			cur, started = cur+string(r), true
+		}
+	}
+	if started {
+		args = append(args, cur)
+	}
+	return args
+}
+
+// newPoll posts the poll so plugin filters apply, then saves it and updates
+// the message with its number, which is used to vote. It expires with the
+// room's ttl like other messages, deleting its votes.
+func (s server) newPoll(ctx context.Context, u user, p poll) error {
+	p.Room, p.Nick, p.Tim = u.room, u.nick, time.Now()
+	smsg, err := s.pollMsg(p)
+	if err != nil {
+		return err
+	}
+
+	smsg, ok := s.post(ctx, u.room, smsg, s.roomTtl(u.room))
+	if !ok {
+		return errors.New("poll was filtered")
+	}
+	p.Num = smsg.Num
+
+	_, err = s.dbase.NamedExec("INSERT INTO polls (room, num, nick, tim, question, opts, open) VALUES (:room, :num, :nick, :tim, :question, :opts, :open)", p)
+	if err != nil {
+		return err
+	}
+
+	return s.updatePoll(ctx, p)
+}
+
+func (s server) getPoll(room string, id string) (poll, error) {
+	num, err := strconv.ParseInt(strings.TrimPrefix(id, "#"), 10, 64)
+	if err != nil {
+		return poll{}, fmt.Errorf("invalid poll id: %v", id)
+	}
+
+	p := poll{}
+	err = s.dbase.Get(&p, "SELECT * FROM polls WHERE room = $1 AND num = $2", room, num)
+	if err != nil {
+		return poll{}, fmt.Errorf("poll not found: #%v", num)
+	}
+
+	return p, nil
+}
+
+func (s server) vote(ctx context.Context, u user, args string) error {
+	// votes are counted per nick, so guests could vote again with a new one
+	if !u.auth {
+		return errors.New("only registered nicks can vote")
+	}
+	id, choice, _ := strings.Cut(strings.TrimSpace(args), " ")
+	p, err := s.getPoll(u.room, id)
+	if err != nil {
+		return err
+	}
+	if !p.Open {
+		return fmt.Errorf("poll closed: #%v", p.Num)
+	}
+
+	opts := []string{}
+	json.Unmarshal([]byte(p.Opts), &opts)
+	opt, err := strconv.Atoi(strings.TrimSpace(choice))
+	if err != nil || opt < 1 || opt > len(opts) {
+		return fmt.Errorf("invalid option: %v (1-%v)", choice, len(opts))
+	}
+
+	_, err = s.dbase.Exec("INSERT INTO votes (room, num, nick, opt) VALUES ($1, $2, $3, $4) ON CONFLICT (room, num, nick) DO UPDATE SET opt = excluded.opt", p.Room, p.Num, u.nick, opt)
+	if err != nil {
+		return err
+	}
+
+	return s.updatePoll(ctx, p)
+}
+
+func (s server) closePoll(ctx context.Context, u user, id string) error {
+	p, err := s.getPoll(u.room, strings.TrimSpace(id))
+	if err != nil {
+		return err
+	}
+	if (!u.auth || p.Nick != u.nick) && !s.isOp(u, u.room) {
+		return errors.New("only the poll creator or an operator can close a poll")
+	}
+
+	_, err = s.dbase.Exec("UPDATE polls SET open = 0 WHERE room = $1 AND num = $2", p.Room, p.Num)
+	if err != nil {
+		return err
+	}
+
+	p.Open = false
+	return s.updatePoll(ctx, p)
+}
+
+func (s server) updatePoll(ctx context.Context, p poll) error {
+	smsg, err := s.pollMsg(p)
+	if err != nil {
+		return err
+	}
+
+	s.conns.sm.Lock()
+	for i := range s.rhist[p.Room] {
+		if s.rhist[p.Room][i].Num == p.Num {
+			s.rhist[p.Room][i].Msg = smsg.Msg
+			// clients replace the message, keep showing that it expires
+			smsg.Exp = s.rhist[p.Room][i].Exp
+		}
+	}
+	s.conns.sm.Unlock()
+	s.queue(logMsg{Ch: p.Room, Msg: smsg, Op: logUpdate})
+	s.broadcast(ctx, p.Room, smsg)
+	return nil
+}
+
+func (s server) pollMsg(p poll) (c.SMsg, error) {
+	opts := []string{}
+	err := json.Unmarshal([]byte(p.Opts), &opts)
+	if err != nil {
+		return c.SMsg{}, err
+	}
+
+	tally := make([]int, len(opts))
+	votes := []int{}
+	err = s.dbase.Select(&votes, "SELECT opt FROM votes WHERE room = $1 AND num = $2", p.Room, p.Num)
+	if err != nil {
+		return c.SMsg{}, err
+	}
+	for _, v := range votes {
+		if v >= 1 && v <= len(tally) {
+			tally[v-1]++
+		}
+	}
+
+	text := fmt.Sprintf("poll: %v", p.Question)
+	if p.Num > 0 {
+		text = fmt.Sprintf("poll #%v: %v", p.Num, p.Question)
+	}
+	if !p.Open {
+		text += " (closed)"
+	}
+	for i, o := range opts {
+		text += fmt.Sprintf("\n  %v) %v: %v", i+1, o, tally[i])
+	}
+
+	return c.SMsg{Tim: p.Tim, Id: p.Nick, Msg: text, Typ: c.Poll, Num: p.Num}, nil
+}
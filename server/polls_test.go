@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+)
+
+func TestPollExpires(t *testing.T) {
+	s, ts := testServer(t)
+	if err := s.setTtl("general", 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	alice := dialTest(t, ts.URL)
+
+	alice.send(c.NewPoll, `"lunch?" pizza soup`)
+	m := alice.wait(func(m c.SMsg) bool { return m.Typ == c.Poll && m.Num > 0 })
+	if m.Exp == nil {
+		t.Fatalf("poll %+v does not expire", m)
+	}
+	alice.wait(func(e c.SMsg) bool { return e.Typ == c.Expire && e.Num == m.Num })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var n int
+		if err := s.dbase.Get(&n, "SELECT COUNT(*) FROM polls WHERE room = 'general' AND num = $1", m.Num); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("poll kept after it expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := s.getPoll("general", fmt.Sprint(m.Num)); err == nil {
+		t.Error("expired poll found")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+)
+
+// features are advertised to clients in the hello message.
+var features = []string{"marks", "pins", "actions", "expiry", "polls", "commands", "results", "rooms"}
+
+// hello describes the server to clients that negotiated protocol.
+func (s server) hello(protocol string) string {
+	b, _ := json.Marshal(c.ServerHello{
+		Version:  c.Version,
+		Protocol: protocol,
+		MaxLen:   s.cfg().maxLen,
+		History:  s.rhlen,
+		Features: features,
+	})
+	return string(b)
+}
+
+// roomInfo returns the rooms and the number of messages u has not read in each.
+func (s server) roomInfo(u user) []c.RoomInfo {
+	rooms := []c.RoomInfo{}
+	for _, r := range s.roomNames() {
+		rooms = append(rooms, c.RoomInfo{Name: r, Unread: s.unread(u, r)})
+	}
+	return rooms
+}
+
+// sendRooms sends the rooms to a client that negotiated a subprotocol, with
+// the messages u has not read in each.
+func (s server) sendRooms(ctx context.Context, conn *ws.Conn, codec c.Codec, u user) {
+	if conn.Subprotocol() != "" {
+		writeRooms(ctx, conn, codec, s.roomInfo(u))
+	}
+}
+
+func writeRooms(ctx context.Context, conn *ws.Conn, codec c.Codec, rooms []c.RoomInfo) {
+	b, _ := json.Marshal(rooms)
+	c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: string(b), Typ: c.Rooms})
+}
+
+// sendResult tells a client that negotiated a subprotocol its nick or room
+// after a Mv or Cd, with the result of the command.
+func sendResult(ctx context.Context, conn *ws.Conn, codec c.Codec, typ c.SMsgT, msg string, result int64) {
+	if conn.Subprotocol() != "" {
+		c.WriteMsg(ctx, conn, codec, c.SMsg{Tim: time.Now(), Id: "system", Msg: msg, Typ: typ, Num: result})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	c "go-chat/common"
+)
+
+// TestLegacyClient checks that clients without a subprotocol are only sent
+// messages they can show.
+func TestLegacyClient(t *testing.T) {
+	_, ts := testServer(t)
+	client := dialTest(t, ts.URL)
+	legacy := dialProtocol(t, ts.URL, "")
+
+	client.send(c.Temp, "100ms gone soon")
+	m := legacy.waitText("gone soon")
+	client.wait(func(e c.SMsg) bool { return e.Typ == c.Expire && e.Num == m.Num })
+
+	legacy.send(c.Cmds, "")
+	legacy.send(c.Mv, "alice")
+	legacy.send(c.Ls, "")
+	legacy.send(c.Cd, "general")
+	legacy.send(c.Who, "")
+	m = legacy.wait(func(m c.SMsg) bool { return m.Id == "system" })
+	if m.Typ != c.Text {
+		t.Errorf("legacy client was sent %+v", m)
+	}
+	client.send(c.Echo, "after")
+	legacy.wait(func(e c.SMsg) bool {
+		if e.Typ != c.Text && e.Typ != c.Note {
+			t.Errorf("legacy client was sent %+v", e)
+		}
+		return e.Msg == "after"
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+)
+
+var (
+	errRoomExists  = errors.New("room exists")
+	errRoomMissing = errors.New("room does not exist")
+	errRoomInvalid = errors.New("invalid room name")
+)
+
+var reservedRooms = schemaTables()
+
+// schemaTables returns the names of the tables created by schema.
+func schemaTables() []string {
+	names := []string{}
+	for _, stmt := range schema {
+		if rest, ok := strings.CutPrefix(stmt, "CREATE TABLE IF NOT EXISTS "); ok {
+			name, _, _ := strings.Cut(rest, " ")
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func validRoom(room string) bool {
+	return room != "" && alphanumeric(room) && !slices.Contains(reservedRooms, strings.ToLower(room))
+}
+
+func (s server) hasRoom(room string) bool {
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	_, ok := s.rooms[room]
+	return ok
+}
+
+func (s server) roomNames() []string {
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	return slices.Sorted(maps.Keys(s.rooms))
+}
+
+func (s server) mkRoom(room string) error {
+	if !validRoom(room) {
+		return fmt.Errorf("%w: %v", errRoomInvalid, room)
+	}
+	for _, r := range s.roomNames() {
+		if strings.EqualFold(r, room) {
+			return fmt.Errorf("%w: %v", errRoomExists, r)
+		}
+	}
+
+	_, err := s.dbase.Exec(fmt.Sprintf(createRoomTable, room))
+	if err != nil {
+		return err
+	}
+	_, err = s.dbase.Exec("INSERT INTO rooms (name) VALUES ($1)", room)
+	if err != nil {
+		return err
+	}
+	var num int64
+	err = s.dbase.Get(&num, fmt.Sprintf(selectRoomNum, room))
+	if err != nil {
+		return err
+	}
+
+	s.addRoom(room, num)
+	s.bplane.publish(bpEvent{Kind: "mk", Room: room})
+	return nil
+}
+
+// addRoom adds a room created in the database, numbering messages after num.
+func (s server) addRoom(room string, num int64) {
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	s.rnums[room] = num
+	s.rooms[room] = fmt.Sprintf(insertRoomMsg, room)
+}
+
+func (s server) rmRoom(ctx context.Context, room string) error {
+	if room == "general" {
+		return fmt.Errorf("%w: %v", errRoomInvalid, room)
+	}
+	if !s.hasRoom(room) {
+		return fmt.Errorf("%w: %v", errRoomMissing, room)
+	}
+
+	_, err := s.dbase.Exec("DELETE FROM rooms WHERE name = $1", room)
+	if err != nil {
+		return err
+	}
+
+	s.dropRoom(ctx, room)
+	s.bplane.publish(bpEvent{Kind: "rm", Room: room})
+	return nil
+}
+
+// dropRoom removes a room deleted from the database, moving its users to
+// general.
+func (s server) dropRoom(ctx context.Context, room string) {
+	s.streams.closeRoom(room)
+	tim := time.Now()
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	delete(s.rooms, room)
+	delete(s.rttls, room)
+	s.rhist[room] = []c.SMsg{}
+	for cn, r := range s.conns.cm {
+		if r.room == room {
+			r.room = "general"
+			s.conns.cm[cn] = r
+			sendResult(ctx, cn, r.codec, c.Room, r.room, c.Done)
+			c.WriteMsg(ctx, cn, r.codec, c.SMsg{Tim: tim, Id: "system", Msg: "room deleted, reconnected to general", Typ: c.Announce})
+		}
+	}
+}
+
+// roomUsers returns the sorted nicks of the users in room, including users on
+// other instances and on linked servers as nick@server.
+func (s server) roomUsers(room string) []string {
+	users := append(s.localUsers(room), s.bplane.users(room)...)
+	users = append(users, s.links.users(room)...)
+	slices.Sort(users)
+	return users
+}
+
+// localUsers returns the sorted nicks of the users in room on this server.
+func (s server) localUsers(room string) []string {
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	users := []string{}
+	for _, u := range s.conns.cm {
+		if u.room == room {
+			users = append(users, u.nick)
+		}
+	}
+	slices.Sort(users)
+	return users
+}
+
+// kick closes every connection using nick and reports whether any were found.
+func (s server) kick(nick string, reason string) bool {
+	s.conns.sm.Lock()
+	found := []*ws.Conn{}
+	for cn, r := range s.conns.cm {
+		if r.nick == nick {
+			found = append(found, cn)
+		}
+	}
+	s.conns.sm.Unlock()
+
+	for _, cn := range found {
+		go cn.Close(ws.StatusNormalClosure, reason)
+	}
+	return len(found) > 0
+}
+
+// recent returns a copy of the history of room kept in memory.
+func (s server) recent(room string) []c.SMsg {
+	s.conns.sm.Lock()
+	defer s.conns.sm.Unlock()
+	return slices.Clone(s.rhist[room])
+}
+
+func (s server) history(room string, before int64, limit int) ([]c.SMsg, error) {
+	if !s.hasRoom(room) {
+		return nil, fmt.Errorf("%w: %v", errRoomMissing, room)
+	}
+
+	msgs := []c.SMsg{}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE ($1 <= 0 OR num < $1) ORDER BY num DESC LIMIT $2", roomCols, room)
+	err := s.dbase.Select(&msgs, query, before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(msgs)
+	return msgs, nil
+}
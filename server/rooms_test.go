@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestReservedRooms(t *testing.T) {
+	for _, room := range []string{"rooms", "marks", "audit", "hooks", "webhooks", "deliveries", "links", "Hooks"} {
+		if validRoom(room) {
+			t.Errorf("room %v is valid, but it's the name of a table", room)
+		}
+	}
+	if !validRoom("general") {
+		t.Error("room general is invalid")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	c "go-chat/common"
+)
+
+// shrug is an example of a plugin command.
+func init() {
+	registerCommand("shrug", "[message]", `send a message ending with ¯\_(ツ)_/¯`, permAny, shrug)
+}
+
+func shrug(ctx context.Context, s server, u user, args string) (string, error) {
+	s.conns.sm.Lock()
+	ttl := s.rttls[u.room]
+	s.conns.sm.Unlock()
+
+	msg := strings.TrimSpace(args + ` ¯\_(ツ)_/¯`)
+	s.post(ctx, u.room, c.SMsg{Tim: time.Now(), Id: u.nick, Msg: msg}, ttl)
+	return "", nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	ws "github.com/coder/websocket"
+)
+
+func (s server) queue(msg logMsg) bool {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	if s.state.closed {
+		s.log.Warn("dropped message after shutdown", "room", msg.Ch, "num", msg.Msg.Num)
+		return false
+	}
+
+	s.logCh <- msg
+	return true
+}
+
+func (s server) closeAll(ctx context.Context) {
+	s.state.mu.Lock()
+	s.state.closing = true
+	s.state.mu.Unlock()
+
+	s.conns.sm.Lock()
+	conns := slices.Collect(maps.Keys(s.conns.cm))
+	s.conns.sm.Unlock()
+
+	s.log.Info("closing connections", "count", len(conns))
+	for _, conn := range conns {
+		go conn.Close(ws.StatusServiceRestart, "server restarting")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.state.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.conns.sm.Lock()
+		s.log.Warn("grace period expired", "remaining", len(s.conns.cm))
+		for conn := range s.conns.cm {
+			conn.CloseNow()
+		}
+		s.conns.sm.Unlock()
+		<-done
+	}
+}
+
+func (s server) drain() {
+	s.state.mu.Lock()
+	s.state.closed = true
+	close(s.logCh)
+	s.state.mu.Unlock()
+
+	s.log.Info("saving history", "pending", len(s.logCh))
+	<-s.state.logged
+	s.log.Info("history saved")
+}
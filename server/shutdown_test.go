@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+
+	ws "github.com/coder/websocket"
+)
+
+// TestShutdownRefusesConnections checks that connections upgraded after
+// shutdown has started are closed rather than missed by closeAll.
+func TestShutdownRefusesConnections(t *testing.T) {
+	s, ts := testServer(t)
+	dialTest(t, ts.URL)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	s.closeAll(ctx)
+	waitConns(t, s, 0)
+
+	conn, _, err := ws.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http"), &ws.DialOptions{Subprotocols: []string{c.Protocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+	_, _, err = conn.Read(ctx)
+	if status := ws.CloseStatus(err); status != ws.StatusServiceRestart {
+		t.Errorf("connection after shutdown read %v, want status %v", err, ws.StatusServiceRestart)
+	}
+}
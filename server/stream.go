@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	c "go-chat/common"
+)
+
+const streamBuffer = 64
+
+// streams are the subscribers to rooms through the read API.
+type streams struct {
+	mu   sync.Mutex
+	subs map[string]map[chan c.SMsg]struct{}
+}
+
+func newStreams() *streams {
+	return &streams{subs: make(map[string]map[chan c.SMsg]struct{})}
+}
+
+func (st *streams) subscribe(room string) chan c.SMsg {
+	ch := make(chan c.SMsg, streamBuffer)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.subs[room] == nil {
+		st.subs[room] = make(map[chan c.SMsg]struct{})
+	}
+	st.subs[room][ch] = struct{}{}
+	return ch
+}
+
+func (st *streams) unsubscribe(room string, ch chan c.SMsg) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.subs[room][ch]; ok {
+		delete(st.subs[room], ch)
+		close(ch)
+	}
+}
+
+// publish sends smsg to the subscribers of room without blocking. Subscribers
+// that fall behind are closed, they can reconnect with Last-Event-ID to catch
+// up from history.
+func (st *streams) publish(room string, smsg c.SMsg) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for ch := range st.subs[room] {
+		select {
+		case ch <- smsg:
+		default:
+			delete(st.subs[room], ch)
+			close(ch)
+		}
+	}
+}
+
+func (st *streams) closeRoom(room string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for ch := range st.subs[room] {
+		close(ch)
+	}
+	delete(st.subs, room)
+}
+
+func (st *streams) closeAll() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for room, subs := range st.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(st.subs, room)
+	}
+}
+
+// readRoutes is the read-only HTTP API for tools that can't use websockets.
+func (s server) readRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rooms", s.apiRooms)
+	mux.HandleFunc("GET /rooms/{room}/messages", s.apiMessages)
+	mux.HandleFunc("GET /rooms/{room}/stream", s.stream)
+	return s.readAuth(mux)
+}
+
+// readAuth allows the API token as a bearer token, or a registered nick and
+// its password with basic auth.
+func (s server) readAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		if cfg.token == "" && len(cfg.nickm) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		ok := false
+		if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			ok = cfg.token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(cfg.token)) == 1
+		} else if nick, pass, found := r.BasicAuth(); found {
+			expPass, registered := cfg.nickm[nick]
+			ok = registered && subtle.ConstantTimeCompare([]byte(pass), []byte(expPass)) == 1 && !s.banned(nick)
+		}
+		if !ok {
+			s.log.Warn("read api unauthorized", "addr", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer, Basic realm="go-chat"`)
+			apiError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		s.log.Debug("read api", "addr", r.RemoteAddr, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stream sends messages posted to a room as server-sent events, with the
+// message number as the event id. Messages after Last-Event-ID are replayed
+// from history when a client reconnects.
+func (s server) stream(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+	if !s.hasRoom(room) {
+		apiRoomError(w, fmt.Errorf("%w: %v", errRoomMissing, room))
+		return
+	}
+
+	// subscribe before reading history so no messages are missed in between
+	ch := s.streams.subscribe(room)
+	defer s.streams.unsubscribe(room, ch)
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	last, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if last > 0 {
+		for smsg := range s.missed(room, last) {
+			writeEvent(w, smsg)
+			last = smsg.Num
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case smsg, ok := <-ch:
+			if !ok {
+				return
+			}
+			// skip messages already replayed, updates and expiries reuse the
+			// number of the message they change
+			if smsg.Num > 0 && smsg.Num <= last && smsg.Typ != c.Poll && smsg.Typ != c.Expire {
+				continue
+			}
+			writeEvent(w, smsg)
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// missedPage is the number of missed messages read from the database at once.
+const missedPage = 1000
+
+// missed yields the messages in room after last, paging through the database
+// and then the recent history that may not be saved yet.
+func (s server) missed(room string, last int64) iter.Seq[c.SMsg] {
+	return func(yield func(c.SMsg) bool) {
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE num > $1 ORDER BY num LIMIT $2", roomCols, room)
+		for s.hasRoom(room) {
+			msgs := []c.SMsg{}
+			if err := s.dbase.Select(&msgs, query, last, missedPage); err != nil {
+				s.log.Error("missed messages", "room", room, "err", err)
+				break
+			}
+			for _, smsg := range msgs {
+				if !yield(smsg) {
+					return
+				}
+				last = smsg.Num
+			}
+			if len(msgs) < missedPage {
+				break
+			}
+		}
+
+		for _, smsg := range s.recent(room) {
+			if smsg.Num > last {
+				if !yield(smsg) {
+					return
+				}
+				last = smsg.Num
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, smsg c.SMsg) {
+	data, _ := json.Marshal(smsg)
+	if smsg.Num > 0 {
+		fmt.Fprintf(w, "id: %v\n", smsg.Num)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
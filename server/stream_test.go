@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+)
+
+// TestMissed checks that every message after a gap longer than a page of
+// history is replayed, in order.
+func TestMissed(t *testing.T) {
+	s, _ := testServer(t, "--histlen", "10")
+	const n = 2*missedPage + 50
+	for i := range n {
+		s.post(t.Context(), "general", c.SMsg{Tim: time.Now(), Id: "alice", Msg: fmt.Sprint(i)}, 0)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for saved := 0; saved < n-10; {
+		if err := s.dbase.Get(&saved, "SELECT COUNT(*) FROM general"); err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v of %v messages saved", saved, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	want := int64(5)
+	for smsg := range s.missed("general", want) {
+		want++
+		if smsg.Num != want {
+			t.Fatalf("got message %v, want %v", smsg.Num, want)
+		}
+	}
+	if want != n {
+		t.Errorf("replayed up to %v, want %v", want, n)
+	}
+}
@@ -0,0 +1,112 @@
+// Runs the web client against a server without a browser, using a stub DOM
+// and the WebSocket built into node. It exits with 3 if node has no
+// WebSocket. Usage: node --experimental-websocket webclient.js HOST:PORT
+"use strict";
+
+const fs = require("fs");
+const path = require("path");
+const vm = require("vm");
+
+if (typeof WebSocket === "undefined") {
+  console.log("node has no WebSocket");
+  process.exit(3);
+}
+
+class Element {
+  constructor() {
+    this.children = [];
+    this.value = "";
+    this.textContent = "";
+    this.className = "";
+    this.hidden = false;
+    this.scrollHeight = 0;
+    this.scrollTop = 0;
+    this.clientHeight = 0;
+  }
+  append(...nodes) {
+    this.children.push(...nodes);
+  }
+  replaceChildren(...nodes) {
+    this.children = nodes;
+  }
+}
+
+const elements = {};
+const storage = {};
+globalThis.document = {
+  getElementById: (id) => (elements[id] ??= new Element()),
+  createElement: () => new Element(),
+  createTextNode: (text) => ({ textContent: text }),
+};
+globalThis.localStorage = {
+  getItem: (key) => storage[key] ?? null,
+  setItem: (key, value) => (storage[key] = String(value)),
+};
+globalThis.location = { protocol: "http:", host: process.argv[2] };
+
+vm.runInThisContext(fs.readFileSync(path.join(__dirname, "..", "web", "app.js"), "utf8"), { filename: "app.js" });
+// top level declarations of app.js are shared with later scripts
+const state = vm.runInThisContext("state");
+
+// type submits a line as if it was typed in the input.
+function type(line) {
+  elements.input.value = line;
+  elements.compose.onsubmit({ preventDefault() {} });
+}
+
+async function until(what, cond) {
+  const deadline = Date.now() + 5000;
+  while (!cond()) {
+    if (Date.now() > deadline) {
+      throw new Error(`timed out waiting for ${what}, state: ${JSON.stringify({ ...state, ws: undefined })}`);
+    }
+    await new Promise((resolve) => setTimeout(resolve, 10));
+  }
+}
+
+const shown = (text) => state.msgs.some((m) => m.Msg.includes(text));
+
+async function main() {
+  await until("the hello", () => state.hello !== null);
+  await until("the commands", () => state.cmds.some((cmd) => cmd.Name === "cd"));
+  await until("the rooms", () => state.rooms.some((r) => r.Name === "test1"));
+  await until("the history of general", () => shown("hello general"));
+
+  type("/mv alice");
+  await until("the nick", () => state.nick === "alice");
+  if (storage.nick !== "alice") {
+    throw new Error(`stored nick ${storage.nick}`);
+  }
+
+  type("/cd test1");
+  await until("the room", () => state.room === "test1");
+  await until("the history of test1", () => shown("hello test1"));
+  if (shown("hello general")) {
+    throw new Error("history of general kept after /cd");
+  }
+  const current = elements.rooms.children.find((li) => li.className === "current");
+  if (!current || current.textContent !== "test1") {
+    throw new Error(`current room in the sidebar: ${current && current.textContent}`);
+  }
+
+  type("/cd nowhere");
+  await until("the invalid room reply", () => shown("invalid room: nowhere"));
+  if (state.room !== "test1") {
+    throw new Error(`room ${state.room} after an invalid /cd`);
+  }
+
+  type("hi from the web");
+  await until("the message", () => state.msgs.some((m) => m.Id === "alice" && m.Msg === "hi from the web"));
+
+  // replies to commands typed by the user are shown
+  type("/ls");
+  await until("the room list", () => shown("connected to: test1, available: general"));
+}
+
+main().then(
+  () => process.exit(0),
+  (err) => {
+    console.error(err.message);
+    process.exit(1);
+  },
+);
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// web is the browser client, served to plain HTTP requests.
+//
+//go:embed web
+var web embed.FS
+
+func webHandler() (http.Handler, error) {
+	sub, err := fs.Sub(web, "web")
+	if err != nil {
+		return nil, err
+	}
+	return http.FileServerFS(sub), nil
+}
@@ -0,0 +1,345 @@
+// go-chat web client, speaking the gochat.v1 websocket protocol with JSON
+// messages. See common/types.go for the message types.
+"use strict";
+
+const PROTOCOL = "gochat.v1";
+
+// server message types, SMsgT
+const Text = 0, Mark = 1, Action = 2, Note = 3, Announce = 4, Expire = 5, Poll = 6, Commands = 7, Hello = 8,
+  Nick = 9, Room = 10, Rooms = 11;
+// results of Mv and Cd in Nick and Room messages
+const Done = 0;
+
+// client message types, CMsgT
+const Sudo = 0, Echo = 1, Mv = 2, Ls = 3, Cd = 4, Who = 5, Read = 6, Pin = 7, Unpin = 8, Pins = 9,
+  Me = 10, Notice = 11, Temp = 12, NewPoll = 13, Vote = 14, ClosePoll = 15, Cmd = 16, Cmds = 17;
+
+const maxMessages = 1000;
+
+const state = {
+  ws: null,
+  backoff: 1000,
+  hello: null,
+  // commands sent by the server after connecting
+  cmds: [],
+  nick: "",
+  login: localStorage.getItem("nick") || "",
+  password: "",
+  room: "general",
+  // rooms sent by the server with their unread messages, for the sidebar
+  rooms: [],
+  msgs: [],
+  mark: 0,
+  read: 0,
+};
+
+const $ = (id) => document.getElementById(id);
+
+// parse turns a line of input into a message for the server, or null for
+// empty lines and unknown commands. It matches parse in lib/client.
+function parse(cmds, line) {
+  line = line.trim();
+  if (!line.startsWith("/")) {
+    return line ? { Typ: Echo, Msg: line } : null;
+  }
+
+  const text = line.slice(1);
+  const i = text.indexOf(" ");
+  const hasArgs = i >= 0;
+  const name = hasArgs ? text.slice(0, i) : text;
+  const rest = hasArgs ? text.slice(i + 1) : "";
+
+  const cmd = cmds.find((c) => c.Name === name);
+  if (!cmd) {
+    return null;
+  }
+  // arguments in [brackets] are optional
+  const args = cmd.Args || "";
+  if ((hasArgs && args === "") || (!hasArgs && args !== "" && !args.startsWith("["))) {
+    return null;
+  }
+  if (cmd.Typ === Cmd) {
+    return { Typ: Cmd, Msg: text };
+  }
+  return { Typ: cmd.Typ, Msg: rest };
+}
+
+function manText(cmds) {
+  let text = "The current available commands are:\n  man\n    prints this message";
+  for (const cmd of cmds) {
+    if (cmd.Perm === "admin") {
+      continue;
+    }
+    text += "\n  " + (cmd.Name + " " + (cmd.Args || "")).trim() + "\n    " + cmd.Help;
+    if (cmd.Perm === "op") {
+      text += " (operators only)";
+    } else if (cmd.Perm === "auth") {
+      text += " (registered nicks only)";
+    }
+  }
+  return text;
+}
+
+function connect() {
+  const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+  const ws = new WebSocket(scheme + location.host + "/", [PROTOCOL]);
+  state.ws = ws;
+
+  ws.onopen = () => {
+    state.backoff = 1000;
+    // the server sends the history of general again
+    state.msgs = [];
+    setStatus();
+    // older servers don't send a hello
+    if (ws.protocol === "") {
+      restore();
+    }
+  };
+  ws.onmessage = (ev) => receive(JSON.parse(ev.data));
+  ws.onclose = (ev) => {
+    if (state.ws !== ws) {
+      return;
+    }
+    state.ws = null;
+    state.nick = "";
+    setStatus(`disconnected${ev.reason ? ": " + ev.reason : ""}, reconnecting...`);
+    setTimeout(connect, state.backoff);
+    state.backoff = Math.min(state.backoff * 2, 30000);
+  };
+}
+
+function send(typ, msg) {
+  if (!state.ws || state.ws.readyState !== WebSocket.OPEN) {
+    local("not connected to the server");
+    return;
+  }
+  state.ws.send(JSON.stringify({ Typ: typ, Msg: msg }));
+}
+
+// restore requests the list of commands, then logs in and rejoins the room
+// after connecting.
+function restore() {
+  if (state.hello && state.hello.Features.includes("commands")) {
+    send(Cmds, "");
+  }
+  if (state.login) {
+    send(Mv, state.login);
+  }
+  if (state.room !== "general") {
+    send(Cd, state.room);
+  }
+}
+
+function receive(smsg) {
+  switch (smsg.Typ) {
+    case Hello:
+      state.hello = JSON.parse(smsg.Msg);
+      $("input").maxLength = state.hello.MaxLen;
+      restore();
+      return;
+    case Commands:
+      state.cmds = JSON.parse(smsg.Msg);
+      return;
+    case Nick:
+      if (smsg.Num === Done) {
+        state.nick = smsg.Msg;
+        localStorage.setItem("nick", state.nick);
+        setStatus();
+      }
+      return;
+    case Room:
+      if (smsg.Num === Done) {
+        // history for the new room follows
+        state.room = smsg.Msg;
+        state.msgs = [];
+        state.mark = 0;
+        state.read = 0;
+        setStatus();
+        renderRooms();
+      }
+      return;
+    case Rooms:
+      state.rooms = JSON.parse(smsg.Msg);
+      renderRooms();
+      return;
+    case Mark:
+      state.mark = smsg.Num;
+      break;
+    case Poll: {
+      const i = state.msgs.findIndex((m) => m.Num === smsg.Num);
+      if (i >= 0) {
+        state.msgs[i] = smsg;
+      } else {
+        state.msgs.push(smsg);
+      }
+      break;
+    }
+    case Expire:
+      state.msgs = state.msgs.filter((m) => m.Num !== smsg.Num);
+      break;
+    default:
+      state.msgs.push(smsg);
+  }
+  state.msgs = state.msgs.slice(-maxMessages);
+  render();
+}
+
+function local(msg) {
+  state.msgs.push({ Tim: new Date().toISOString(), Id: "system", Msg: msg, Typ: Text, Num: 0 });
+  render();
+}
+
+function setStatus(text) {
+  if (text === undefined) {
+    text = `${state.nick || "anonymous"} in ${state.room}`;
+    if (state.hello) {
+      text += ` on go-chat ${state.hello.Version}`;
+    }
+  }
+  $("status").textContent = text;
+}
+
+function renderRooms() {
+  const ul = $("rooms");
+  ul.replaceChildren(...state.rooms.map((r) => {
+    const li = document.createElement("li");
+    li.textContent = r.Name + (r.Unread > 0 ? ` (${r.Unread})` : "");
+    li.className = r.Name === state.room ? "current" : "";
+    li.onclick = () => send(Cd, r.Name);
+    return li;
+  }));
+}
+
+function render() {
+  const ol = $("messages");
+  const atBottom = ol.scrollHeight - ol.scrollTop - ol.clientHeight < 8;
+
+  const items = [];
+  state.msgs.forEach((m, i) => {
+    items.push(renderMessage(m));
+    if (state.mark > 0 && m.Num === state.mark && i < state.msgs.length - 1) {
+      const li = document.createElement("li");
+      li.className = "divider";
+      li.textContent = "── new messages ──";
+      items.push(li);
+    }
+  });
+  ol.replaceChildren(...items);
+
+  $("older").hidden = !state.password || !state.msgs.some((m) => m.Num > 0);
+  if (atBottom) {
+    ol.scrollTop = ol.scrollHeight;
+    markRead();
+  }
+}
+
+function renderMessage(m) {
+  const li = document.createElement("li");
+  const tim = new Date(m.Tim);
+  li.title = (m.Num > 0 ? `#${m.Num} ` : "") + tim.toLocaleString();
+
+  const span = (cls, text) => {
+    const s = document.createElement("span");
+    s.className = cls;
+    s.textContent = text;
+    return s;
+  };
+
+  let nick = m.Id + ":";
+  if (m.Typ === Announce) {
+    li.className = "announce";
+    nick = "***";
+  } else if (m.Id === "system") {
+    li.className = "system";
+  } else if (m.Typ === Action) {
+    li.className = "action";
+    nick = "* " + m.Id;
+  } else if (m.Typ === Note) {
+    li.className = "note";
+    nick = "-" + m.Id + "-";
+  }
+
+  li.append(span("tim", tim.toLocaleTimeString()));
+  if (m.Exp) {
+    li.append(span("exp", "⌛ "));
+  }
+  li.append(span("nick", nick), document.createTextNode(m.Msg));
+  return li;
+}
+
+// markRead sends a read marker for the last numbered message once it has
+// been scrolled into view.
+function markRead() {
+  const last = state.msgs.findLast((m) => m.Num > 0);
+  if (last && last.Num > state.read && state.ws) {
+    state.read = last.Num;
+    send(Read, String(last.Num));
+  }
+}
+
+// loadOlder fetches earlier messages in the room from the read API, which
+// needs a registered nick and password.
+async function loadOlder() {
+  const first = state.msgs.find((m) => m.Num > 0);
+  if (!first) {
+    return;
+  }
+
+  const bytes = new TextEncoder().encode(state.nick + ":" + state.password);
+  const resp = await fetch(`/rooms/${encodeURIComponent(state.room)}/messages?limit=50&before=${first.Num}`, {
+    headers: { Authorization: "Basic " + btoa(String.fromCharCode(...bytes)) },
+  });
+  if (!resp.ok) {
+    local(`failed to load older messages: ${resp.status} ${resp.statusText}`);
+    return;
+  }
+
+  const older = await resp.json();
+  const ol = $("messages");
+  const height = ol.scrollHeight;
+  state.msgs = older.concat(state.msgs);
+  render();
+  ol.scrollTop = ol.scrollHeight - height;
+}
+
+$("login").onsubmit = (ev) => {
+  ev.preventDefault();
+  const nick = $("nick").value.trim();
+  state.password = $("password").value;
+  state.login = state.password ? nick + ":" + state.password : nick;
+  $("password").value = "";
+  send(Mv, state.login);
+};
+
+$("compose").onsubmit = (ev) => {
+  ev.preventDefault();
+  const text = $("input").value.trim();
+  $("input").value = "";
+  if (text === "/man") {
+    local(manText(state.cmds));
+    return;
+  }
+
+  const cmsg = parse(state.cmds, text);
+  if (cmsg) {
+    if (cmsg.Typ === Mv) {
+      state.login = cmsg.Msg;
+      state.password = cmsg.Msg.split(":").slice(1).join(":");
+    }
+    send(cmsg.Typ, cmsg.Msg);
+  } else if (text.startsWith("/")) {
+    local("Unrecognised command, use /man for more info");
+  }
+};
+
+$("messages").onscroll = () => {
+  const ol = $("messages");
+  if (ol.scrollHeight - ol.scrollTop - ol.clientHeight < 8) {
+    markRead();
+  }
+};
+
+$("older").onclick = loadOlder;
+$("nick").value = state.login.split(":")[0];
+
+connect();
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+)
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+func TestWeb(t *testing.T) {
+	_, ts := testServer(t)
+
+	res, page := get(t, ts.URL+"/")
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("status %v, content type %v", res.Status, res.Header.Get("Content-Type"))
+	}
+
+	types := map[string]string{".js": "text/javascript", ".css": "text/css"}
+	assets := regexp.MustCompile(`(?:src|href)="([^"]+)"`).FindAllStringSubmatch(page, -1)
+	if len(assets) < 2 {
+		t.Fatalf("found %v assets in the page", len(assets))
+	}
+	for _, m := range assets {
+		t.Run(m[1], func(t *testing.T) {
+			res, body := get(t, ts.URL+"/"+m[1])
+			if res.StatusCode != http.StatusOK || body == "" {
+				t.Fatalf("status %v, %v bytes", res.Status, len(body))
+			}
+			for ext, typ := range types {
+				if strings.HasSuffix(m[1], ext) && !strings.HasPrefix(res.Header.Get("Content-Type"), typ) {
+					t.Errorf("content type %v, want %v", res.Header.Get("Content-Type"), typ)
+				}
+			}
+		})
+	}
+
+	if res, _ := get(t, ts.URL+"/missing.js"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("status %v for a missing asset", res.Status)
+	}
+}
+
+// TestWebClient runs the web client in node against the server, with a stub
+// DOM, if node is installed.
+func TestWebClient(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	s, ts := testServer(t)
+	s.post(t.Context(), "general", c.SMsg{Tim: time.Now(), Id: "bob", Msg: "hello general"}, 0)
+	s.post(t.Context(), "test1", c.SMsg{Tim: time.Now(), Id: "bob", Msg: "hello test1"}, 0)
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, node, "--experimental-websocket", "testdata/webclient.js", ts.Listener.Addr().String())
+	out, err := cmd.CombinedOutput()
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 3 {
+		t.Skipf("%s", out)
+	}
+	if err != nil {
+		t.Errorf("web client: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	c "go-chat/common"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const createWebhooksTable = "CREATE TABLE IF NOT EXISTS webhooks (id INTEGER PRIMARY KEY AUTOINCREMENT, room TEXT, url TEXT, secret TEXT, events TEXT, tim DATETIME)"
+const createDeliveriesTable = "CREATE TABLE IF NOT EXISTS deliveries (hook INTEGER, event TEXT, attempt INTEGER, status INTEGER, error TEXT, tim DATETIME)"
+
+const (
+	webhookWorkers  = 4
+	webhookAttempts = 5
+	webhookQueue    = 256
+	// deliveries logged for each webhook
+	webhookDeliveries = 100
+)
+
+type webhook struct {
+	Id     int64     `json:"id"`
+	Room   string    `json:"room"`
+	Url    string    `json:"url"`
+	Secret string    `json:"secret,omitempty"`
+	Events string    `json:"events"`
+	Tim    time.Time `json:"tim"`
+}
+
+type delivery struct {
+	Hook    int64     `json:"hook"`
+	Event   string    `json:"event"`
+	Attempt int       `json:"attempt"`
+	Status  int       `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Tim     time.Time `json:"tim"`
+}
+
+// event is the JSON payload sent to webhooks. The X-Go-Chat-Signature header
+// is the HMAC-SHA256 of the X-Go-Chat-Timestamp header, a dot and the payload,
+// using the webhook secret, so receivers can reject old deliveries replayed.
+type event struct {
+	Event   string    `json:"event"`
+	Room    string    `json:"room"`
+	Nick    string    `json:"nick"`
+	Keyword string    `json:"keyword,omitempty"`
+	Msg     *c.SMsg   `json:"msg,omitempty"`
+	Tim     time.Time `json:"tim"`
+}
+
+type job struct {
+	hook    webhook
+	event   string
+	body    []byte
+	attempt int
+}
+
+type webhooks struct {
+	db     *sqlx.DB
+	log    *slog.Logger
+	client *http.Client
+	jobs   chan job
+	// delay before the first retry, doubled for each one
+	backoff time.Duration
+	// deliveries kept for each webhook, older ones are pruned
+	keep int
+	mu   sync.RWMutex
+	list []webhook
+}
+
+func newWebhooks(db *sqlx.DB, log *slog.Logger) (*webhooks, error) {
+	w := &webhooks{
+		db:      db,
+		log:     log,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		jobs:    make(chan job, webhookQueue),
+		backoff: time.Second,
+		keep:    webhookDeliveries,
+	}
+	return w, w.load()
+}
+
+func (w *webhooks) load() error {
+	list := []webhook{}
+	err := w.db.Select(&list, "SELECT * FROM webhooks ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.list = list
+	w.mu.Unlock()
+	return nil
+}
+
+// exists reports whether the webhook id has not been removed.
+func (w *webhooks) exists(id int64) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return slices.ContainsFunc(w.list, func(h webhook) bool { return h.Id == id })
+}
+
+func (w *webhooks) all() []webhook {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return slices.Clone(w.list)
+}
+
+// parseEvents checks a comma separated list of events: message, join, or
+// match:<keyword> for messages containing keyword.
+func parseEvents(spec string) (string, error) {
+	events := []string{}
+	for _, e := range strings.Split(spec, ",") {
+		e = strings.TrimSpace(e)
+		if kw, ok := strings.CutPrefix(e, "match:"); ok && kw != "" {
+			events = append(events, "match:"+strings.ToLower(kw))
+		} else if e == "message" || e == "join" {
+			events = append(events, e)
+		} else {
+			return "", fmt.Errorf("invalid event: %v [message, join, match:<keyword>]", e)
+		}
+	}
+	return strings.Join(events, ","), nil
+}
+
+func (w *webhooks) add(room string, events string, target string) (webhook, error) {
+	events, err := parseEvents(events)
+	if err != nil {
+		return webhook{}, err
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webhook{}, fmt.Errorf("invalid url: %v", target)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return webhook{}, err
+	}
+
+	h := webhook{Room: room, Url: u.String(), Secret: hex.EncodeToString(b), Events: events, Tim: time.Now()}
+	res, err := w.db.NamedExec("INSERT INTO webhooks (room, url, secret, events, tim) VALUES (:room, :url, :secret, :events, :tim)", h)
+	if err != nil {
+		return webhook{}, err
+	}
+	h.Id, err = res.LastInsertId()
+	if err != nil {
+		return webhook{}, err
+	}
+
+	return h, w.load()
+}
+
+func (w *webhooks) remove(id int64) (bool, error) {
+	res, err := w.db.Exec("DELETE FROM webhooks WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	_, err = w.db.Exec("DELETE FROM deliveries WHERE hook = $1", id)
+	if err != nil {
+		return false, err
+	}
+	return true, w.load()
+}
+
+func (w *webhooks) deliveries(id int64, n int) ([]delivery, error) {
+	list := []delivery{}
+	err := w.db.Select(&list, "SELECT * FROM (SELECT * FROM deliveries WHERE hook = $1 ORDER BY tim DESC LIMIT $2) ORDER BY tim", id, n)
+	return list, err
+}
+
+func (w *webhooks) text() string {
+	list := w.all()
+	if len(list) == 0 {
+		return "No outgoing webhooks"
+	}
+
+	text := "Outgoing webhooks:"
+	for _, h := range list {
+		text += fmt.Sprintf("\n  %v: %v %v -> %v", h.Id, h.Room, h.Events, h.Url)
+	}
+	return text
+}
+
+func (w *webhooks) deliveriesText(id int64) string {
+	list, err := w.deliveries(id, 10)
+	if err != nil {
+		return fmt.Sprintf("Failed: %v", err)
+	}
+	if len(list) == 0 {
+		return fmt.Sprintf("No deliveries for webhook %v", id)
+	}
+
+	text := fmt.Sprintf("Recent deliveries for webhook %v:", id)
+	for _, d := range list {
+		text += fmt.Sprintf("\n  %v %v attempt %v: %v %v", d.Tim.Format(time.DateTime), d.Event, d.Attempt, d.Status, d.Error)
+	}
+	return text
+}
+
+// emit queues ev for every webhook in its room that subscribes to it. It never
+// blocks, events are dropped if the delivery queue is full.
+func (w *webhooks) emit(ev event) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, h := range w.list {
+		if h.Room != ev.Room {
+			continue
+		}
+		for _, e := range strings.Split(h.Events, ",") {
+			if e == ev.Event {
+				w.enqueue(h, ev)
+			} else if kw, ok := strings.CutPrefix(e, "match:"); ok && ev.Event == "message" && strings.Contains(strings.ToLower(ev.Msg.Msg), kw) {
+				match := ev
+				match.Event, match.Keyword = "keyword", kw
+				w.enqueue(h, match)
+			}
+		}
+	}
+}
+
+func (w *webhooks) enqueue(h webhook, ev event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		w.log.Error("webhook", "id", h.Id, "err", err)
+		return
+	}
+	w.retry(job{hook: h, event: ev.Event, body: body, attempt: 1})
+}
+
+func (w *webhooks) retry(j job) {
+	select {
+	case w.jobs <- j:
+	default:
+		w.log.Warn("webhook queue full, dropped event", "id", j.hook.Id, "event", j.event)
+	}
+}
+
+func (w *webhooks) run(ctx context.Context) {
+	for range webhookWorkers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-w.jobs:
+					w.deliver(ctx, j)
+				}
+			}
+		}()
+	}
+}
+
+// sign returns the signature of body sent at the unix timestamp tim.
+func sign(secret string, tim string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tim + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhooks) deliver(ctx context.Context, j job) {
+	// jobs queued or waiting to be retried hold a copy of the webhook
+	if !w.exists(j.hook.Id) {
+		w.log.Debug("webhook removed, dropped event", "id", j.hook.Id, "event", j.event)
+		return
+	}
+	tim := strconv.FormatInt(time.Now().Unix(), 10)
+
+	status := 0
+	req, err := http.NewRequestWithContext(ctx, "POST", j.hook.Url, bytes.NewReader(j.body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "go-chat/"+c.Version)
+		req.Header.Set("X-Go-Chat-Event", j.event)
+		req.Header.Set("X-Go-Chat-Timestamp", tim)
+		req.Header.Set("X-Go-Chat-Signature", sign(j.hook.Secret, tim, j.body))
+
+		var resp *http.Response
+		resp, err = w.client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+			status = resp.StatusCode
+			if status < 200 || status > 299 {
+				err = fmt.Errorf("unexpected status: %v", resp.Status)
+			}
+		}
+	}
+
+	d := delivery{Hook: j.hook.Id, Event: j.event, Attempt: j.attempt, Status: status, Tim: time.Now()}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	_, dbErr := w.db.NamedExec("INSERT INTO deliveries (hook, event, attempt, status, error, tim) VALUES (:hook, :event, :attempt, :status, :error, :tim)", d)
+	if dbErr == nil {
+		_, dbErr = w.db.Exec("DELETE FROM deliveries WHERE hook = $1 AND rowid <= (SELECT rowid FROM deliveries WHERE hook = $1 ORDER BY rowid DESC LIMIT 1 OFFSET $2)", j.hook.Id, w.keep)
+	}
+	if dbErr != nil {
+		w.log.Error("webhook delivery log", "id", j.hook.Id, "err", dbErr)
+	}
+
+	if err == nil {
+		w.log.Debug("webhook delivered", "id", j.hook.Id, "event", j.event, "attempt", j.attempt)
+		return
+	}
+	if j.attempt >= webhookAttempts || ctx.Err() != nil {
+		w.log.Warn("webhook failed", "id", j.hook.Id, "event", j.event, "attempt", j.attempt, "err", err)
+		return
+	}
+
+	backoff := w.backoff << (j.attempt - 1)
+	w.log.Info("webhook retrying", "id", j.hook.Id, "event", j.event, "attempt", j.attempt, "backoff", backoff, "err", err)
+	j.attempt++
+	time.AfterFunc(backoff, func() { w.retry(j) })
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	c "go-chat/common"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	attempts []time.Time
+	bodies   [][]byte
+	fail     int
+	done     chan struct{}
+}
+
+// newReceiver returns a webhook receiver which checks signatures with secret,
+// fails the first fail deliveries, and is done after want of them.
+func newReceiver(t *testing.T, secret *string, fail int, want int) (*receiver, *httptest.Server) {
+	rc := &receiver{fail: fail, done: make(chan struct{})}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		tim := r.Header.Get("X-Go-Chat-Timestamp")
+		if sent, err := strconv.ParseInt(tim, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+			t.Errorf("invalid timestamp %q", tim)
+		}
+		if sig := r.Header.Get("X-Go-Chat-Signature"); sig != sign(*secret, tim, body) {
+			t.Errorf("signature %v does not match the body", sig)
+		}
+
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		rc.attempts = append(rc.attempts, time.Now())
+		rc.bodies = append(rc.bodies, body)
+		if len(rc.attempts) == want {
+			close(rc.done)
+		}
+		if len(rc.attempts) <= rc.fail {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return rc, ts
+}
+
+func (rc *receiver) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-rc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for deliveries")
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	s, _ := testServer(t)
+	s.hooks.backoff = 10 * time.Millisecond
+	var secret string
+	rc, ts := newReceiver(t, &secret, 2, 3)
+	h, err := s.hooks.add("general", "message", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = h.Secret
+
+	s.post(t.Context(), "general", c.SMsg{Tim: time.Now(), Id: "alice", Msg: "hello"}, 0)
+	rc.wait(t)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	ev := event{}
+	if err := json.Unmarshal(rc.bodies[2], &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event != "message" || ev.Nick != "alice" || ev.Msg == nil || ev.Msg.Msg != "hello" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	for i := 1; i < len(rc.attempts); i++ {
+		if gap, min := rc.attempts[i].Sub(rc.attempts[i-1]), s.hooks.backoff<<(i-1); gap < min {
+			t.Errorf("retry %v after %v, want at least %v", i, gap, min)
+		}
+	}
+
+	list := waitDeliveries(t, s, h.Id, 3)
+	for i, d := range list {
+		status := http.StatusServiceUnavailable
+		if i == 2 {
+			status = http.StatusOK
+		}
+		if d.Attempt != i+1 || d.Status != status || d.Event != "message" {
+			t.Errorf("delivery %v: %+v, want attempt %v with status %v", i, d, i+1, status)
+		}
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	s, _ := testServer(t)
+	s.hooks.backoff = time.Millisecond
+	var secret string
+	rc, ts := newReceiver(t, &secret, webhookAttempts+1, webhookAttempts)
+	h, err := s.hooks.add("general", "message", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = h.Secret
+
+	s.post(t.Context(), "general", c.SMsg{Tim: time.Now(), Id: "alice", Msg: "hello"}, 0)
+	rc.wait(t)
+	list := waitDeliveries(t, s, h.Id, webhookAttempts)
+
+	// wait longer than the next retry would have taken
+	time.Sleep(s.hooks.backoff<<webhookAttempts + 50*time.Millisecond)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.attempts) != webhookAttempts {
+		t.Errorf("%v attempts, want %v", len(rc.attempts), webhookAttempts)
+	}
+	for _, d := range list {
+		if d.Status != http.StatusServiceUnavailable || d.Error == "" {
+			t.Errorf("delivery %+v, want a failure", d)
+		}
+	}
+}
+
+// waitDeliveries waits for n deliveries to be logged for the webhook id.
+func waitDeliveries(t *testing.T, s server, id int64, n int) []delivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list, err := s.hooks.deliveries(id, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) >= n || time.Now().After(deadline) {
+			if len(list) != n {
+				t.Fatalf("%v deliveries logged, want %v", len(list), n)
+			}
+			return list
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookPrune(t *testing.T) {
+	s, _ := testServer(t)
+	s.hooks.keep = 3
+	var secret string
+	rc, ts := newReceiver(t, &secret, 0, 5)
+	h, err := s.hooks.add("general", "message", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = h.Secret
+
+	for i := range 5 {
+		s.post(t.Context(), "general", c.SMsg{Tim: time.Now(), Id: "alice", Msg: fmt.Sprint("hello ", i)}, 0)
+	}
+	rc.wait(t)
+	waitDeliveries(t, s, h.Id, 3)
+
+	if _, err := s.hooks.remove(h.Id); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.hooks.deliveries(h.Id, 100); err != nil || len(list) != 0 {
+		t.Errorf("%v deliveries kept for a removed webhook, %v", len(list), err)
+	}
+}
+
+func TestWebhookRemovedRetry(t *testing.T) {
+	s, _ := testServer(t)
+	s.hooks.backoff = 100 * time.Millisecond
+	var secret string
+	rc, ts := newReceiver(t, &secret, webhookAttempts, 1)
+	h, err := s.hooks.add("general", "message", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = h.Secret
+
+	s.post(t.Context(), "general", c.SMsg{Tim: time.Now(), Id: "alice", Msg: "hello"}, 0)
+	rc.wait(t)
+	if _, err := s.hooks.remove(h.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait longer than the retry would have taken
+	time.Sleep(2 * s.hooks.backoff)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.attempts) != 1 {
+		t.Errorf("%v attempts, want no retries after the webhook was removed", len(rc.attempts))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	c "go-chat/common"
+)
+
+// wireConn counts the bytes sent and received on a connection once it has been
+// upgraded to a websocket, so they can be compared with the size of the
+// messages to see how much compression saves.
+type wireConn struct {
+	net.Conn
+	stats *metrics
+	ws    atomic.Bool
+}
+
+func (wc *wireConn) Read(b []byte) (int, error) {
+	n, err := wc.Conn.Read(b)
+	if wc.ws.Load() {
+		wc.stats.wire(0, n)
+	}
+	return n, err
+}
+
+func (wc *wireConn) Write(b []byte) (int, error) {
+	n, err := wc.Conn.Write(b)
+	if wc.ws.Load() {
+		wc.stats.wire(n, 0)
+	}
+	return n, err
+}
+
+type wireListener struct {
+	net.Listener
+	stats *metrics
+}
+
+func (l wireListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &wireConn{Conn: conn, stats: l.stats}, nil
+}
+
+type connKey struct{}
+
+// connContext is used as http.Server.ConnContext so handlers can find the
+// wireConn for a request.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// upgraded starts counting the bytes on the connection for r.
+func upgraded(r *http.Request) {
+	if wc, ok := r.Context().Value(connKey{}).(*wireConn); ok {
+		wc.ws.Store(true)
+	}
+}
+
+// meteredCodec counts the size of encoded messages before compression.
+type meteredCodec struct {
+	c.Codec
+	stats *metrics
+}
+
+func (mc meteredCodec) Marshal(v any) ([]byte, error) {
+	data, err := mc.Codec.Marshal(v)
+	mc.stats.payload(len(data), 0)
+	return data, err
+}
+
+func (mc meteredCodec) Unmarshal(data []byte, v any) error {
+	mc.stats.payload(0, len(data))
+	return mc.Codec.Unmarshal(data, v)
+}